@@ -0,0 +1,503 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// arithOps are the operators of arithmetic expressions, sorted so that the
+// longest operator sharing a prefix comes first.
+var arithOps = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "&", "|", "^", "!", "~", "?", ":", "=", "(", ")", ",",
+}
+
+// arithLevels are the binary operators from the lowest to the highest
+// precedence, all of them left associative.
+var arithLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// maxArithDepth limits the evaluation of variables holding expressions
+// referring to themselves.
+const maxArithDepth = 64
+
+type arithToken struct {
+	op   string // operator, or "" for an operand
+	text string // number or variable name
+}
+
+// arith evaluates an arithmetic expression with 64-bit integers, C operators
+// and shell variables, which are evaluated as expressions themselves and
+// count as 0 if unset or empty.
+type arith struct {
+	shell *Shell
+	expr  string
+	toks  []arithToken
+	pos   int
+	skip  int // > 0 in operands short-circuited by &&, || or ?:
+	depth int
+}
+
+// evalArith evaluates the arithmetic expression expr.
+func (shell *Shell) evalArith(expr string) (int64, error) {
+	return shell.evalArithDepth(expr, 0)
+}
+
+func (shell *Shell) evalArithDepth(expr string, depth int) (int64, error) {
+	if depth > maxArithDepth {
+		return 0, NewArithError(expr, "expression recursion level exceeded")
+	}
+
+	toks, err := tokenizeArith(expr)
+	if err != nil {
+		return 0, err
+	}
+	if len(toks) == 0 {
+		return 0, nil
+	}
+
+	a := &arith{shell: shell, expr: expr, toks: toks, depth: depth}
+	n, err := a.comma()
+	if err != nil {
+		return 0, err
+	}
+	if a.pos < len(a.toks) {
+		return 0, a.syntaxError()
+	}
+	return n, nil
+}
+
+func tokenizeArith(expr string) ([]arithToken, error) {
+	var toks []arithToken
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case isDigit(ch) || isNameStart(ch):
+			start := i
+			for i < len(expr) && (isDigit(expr[i]) || isNameStart(expr[i]) || (isDigit(expr[start]) && (expr[i] == '#' || expr[i] == '@'))) {
+				i++
+			}
+			toks = append(toks, arithToken{text: expr[start:i]})
+		default:
+			op := ""
+			for _, o := range arithOps {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, NewArithError(expr, "syntax error: invalid arithmetic operator (error token is \""+expr[i:]+"\")")
+			}
+			toks = append(toks, arithToken{op: op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+func (a *arith) peek() string {
+	if a.pos >= len(a.toks) {
+		return ""
+	}
+	return a.toks[a.pos].op
+}
+
+// peekName returns the variable name of the next token, if it's one.
+func (a *arith) peekName() (string, bool) {
+	if a.pos >= len(a.toks) || a.toks[a.pos].op != "" || !isNameStart(a.toks[a.pos].text[0]) {
+		return "", false
+	}
+	return a.toks[a.pos].text, true
+}
+
+func (a *arith) expect(op string) error {
+	if a.peek() != op {
+		return a.syntaxError()
+	}
+	a.pos++
+	return nil
+}
+
+func (a *arith) syntaxError() error {
+	if a.pos >= len(a.toks) {
+		return NewArithError(a.expr, "syntax error: operand expected (error token is \"\")")
+	}
+	token := a.toks[a.pos].op
+	if token == "" {
+		token = a.toks[a.pos].text
+	}
+	return NewArithError(a.expr, "syntax error in expression (error token is \""+token+"\")")
+}
+
+func (a *arith) comma() (int64, error) {
+	n, err := a.assign()
+	for err == nil && a.peek() == "," {
+		a.pos++
+		n, err = a.assign()
+	}
+	return n, err
+}
+
+func (a *arith) assign() (int64, error) {
+	name, ok := a.peekName()
+	if ok && a.pos+1 < len(a.toks) {
+		op := a.toks[a.pos+1].op
+		if op == "=" || (strings.HasSuffix(op, "=") && !slices.Contains([]string{"==", "!=", "<=", ">="}, op)) {
+			a.pos += 2
+			value, err := a.assign()
+			if err != nil {
+				return 0, err
+			}
+			if op != "=" {
+				current, err := a.variable(name)
+				if err != nil {
+					return 0, err
+				}
+				if value, err = a.apply(strings.TrimSuffix(op, "="), current, value); err != nil {
+					return 0, err
+				}
+			}
+			return value, a.set(name, value)
+		}
+	}
+	return a.ternary()
+}
+
+func (a *arith) ternary() (int64, error) {
+	cond, err := a.binary(0)
+	if err != nil || a.peek() != "?" {
+		return cond, err
+	}
+	a.pos++
+
+	if cond == 0 {
+		a.skip++
+	}
+	then, err := a.assign()
+	if cond == 0 {
+		a.skip--
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := a.expect(":"); err != nil {
+		return 0, err
+	}
+
+	if cond != 0 {
+		a.skip++
+	}
+	otherwise, err := a.assign()
+	if cond != 0 {
+		a.skip--
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if cond != 0 {
+		return then, nil
+	}
+	return otherwise, nil
+}
+
+func (a *arith) binary(level int) (int64, error) {
+	if level == len(arithLevels) {
+		return a.power()
+	}
+
+	x, err := a.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := a.peek()
+		if !slices.Contains(arithLevels[level], op) {
+			return x, nil
+		}
+		a.pos++
+
+		// the right operand of && and || is only evaluated if needed
+		short := (op == "&&" && x == 0) || (op == "||" && x != 0)
+		if short {
+			a.skip++
+		}
+		y, err := a.binary(level + 1)
+		if short {
+			a.skip--
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case op == "&&":
+			x = boolInt(x != 0 && y != 0)
+		case op == "||":
+			x = boolInt(x != 0 || y != 0)
+		default:
+			if x, err = a.apply(op, x, y); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// power parses exponentiation, which is right associative and binds weaker
+// than the unary operators: -2**2 is 4.
+func (a *arith) power() (int64, error) {
+	x, err := a.unary()
+	if err != nil || a.peek() != "**" {
+		return x, err
+	}
+	a.pos++
+	y, err := a.power()
+	if err != nil {
+		return 0, err
+	}
+	return a.apply("**", x, y)
+}
+
+func (a *arith) unary() (int64, error) {
+	switch op := a.peek(); op {
+	case "-", "+", "!", "~":
+		a.pos++
+		x, err := a.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "-":
+			return -x, nil
+		case "!":
+			return boolInt(x == 0), nil
+		case "~":
+			return ^x, nil
+		}
+		return x, nil
+	case "++", "--":
+		a.pos++
+		name, ok := a.peekName()
+		if !ok {
+			return 0, a.syntaxError()
+		}
+		a.pos++
+		x, err := a.variable(name)
+		if err != nil {
+			return 0, err
+		}
+		if op == "++" {
+			x++
+		} else {
+			x--
+		}
+		return x, a.set(name, x)
+	}
+	return a.postfix()
+}
+
+func (a *arith) postfix() (int64, error) {
+	name, ok := a.peekName()
+	if !ok {
+		return a.primary()
+	}
+	a.pos++
+
+	x, err := a.variable(name)
+	if err != nil {
+		return 0, err
+	}
+	switch op := a.peek(); op {
+	case "++", "--":
+		a.pos++
+		if op == "++" {
+			return x, a.set(name, x+1)
+		}
+		return x, a.set(name, x-1)
+	}
+	return x, nil
+}
+
+func (a *arith) primary() (int64, error) {
+	if a.pos >= len(a.toks) {
+		return 0, a.syntaxError()
+	}
+
+	tok := a.toks[a.pos]
+	if tok.op == "(" {
+		a.pos++
+		x, err := a.comma()
+		if err != nil {
+			return 0, err
+		}
+		return x, a.expect(")")
+	}
+	if tok.op != "" {
+		return 0, a.syntaxError()
+	}
+
+	a.pos++
+	n, ok := parseArithNumber(tok.text)
+	if !ok {
+		return 0, NewArithError(a.expr, "value too great for base (error token is \""+tok.text+"\")")
+	}
+	return n, nil
+}
+
+// variable returns the value of a variable, evaluating it as an expression.
+func (a *arith) variable(name string) (int64, error) {
+	value, _ := a.shell.lookupParam(name)
+	if value == "" {
+		return 0, nil
+	}
+	if n, ok := parseArithNumber(value); ok {
+		return n, nil
+	}
+	return a.shell.evalArithDepth(value, a.depth+1)
+}
+
+func (a *arith) set(name string, value int64) error {
+	if a.skip > 0 {
+		return nil
+	}
+	return a.shell.setParam(name, strconv.FormatInt(value, 10))
+}
+
+func (a *arith) apply(op string, x int64, y int64) (int64, error) {
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/", "%":
+		if y == 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, NewArithError(a.expr, "division by 0")
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "**":
+		if y < 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, NewArithError(a.expr, "exponent less than 0")
+		}
+		// by squaring, which wraps around the way repeated
+		// multiplication does
+		n := int64(1)
+		for ; y > 0; y >>= 1 {
+			if y&1 == 1 {
+				n *= x
+			}
+			x *= x
+		}
+		return n, nil
+	case "<<":
+		return x << uint64(y&63), nil
+	case ">>":
+		return x >> uint64(y&63), nil
+	case "<":
+		return boolInt(x < y), nil
+	case "<=":
+		return boolInt(x <= y), nil
+	case ">":
+		return boolInt(x > y), nil
+	case ">=":
+		return boolInt(x >= y), nil
+	case "==":
+		return boolInt(x == y), nil
+	case "!=":
+		return boolInt(x != y), nil
+	case "&":
+		return x & y, nil
+	case "^":
+		return x ^ y, nil
+	case "|":
+		return x | y, nil
+	}
+	return 0, a.syntaxError()
+}
+
+// parseArithNumber parses an integer constant: decimal, octal with a leading
+// 0, hexadecimal with 0x or in any base from 2 to 64 as `base#digits`.
+func parseArithNumber(s string) (int64, bool) {
+	s = strings.TrimSpace(s)
+	base := 10
+	switch {
+	case strings.Contains(s, "#"):
+		b, digits, _ := strings.Cut(s, "#")
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 2 || n > 64 {
+			return 0, false
+		}
+		base, s = n, digits
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base, s = 16, s[2:]
+	case len(s) > 1 && s[0] == '0':
+		base, s = 8, s[1:]
+	}
+	if s == "" {
+		return 0, false
+	}
+
+	var n int64
+	for i := 0; i < len(s); i++ {
+		d := arithDigit(s[i], base)
+		if d < 0 || d >= base {
+			return 0, false
+		}
+		n = n*int64(base) + int64(d)
+	}
+	return n, true
+}
+
+// arithDigit returns the value of a digit: 0-9, then a-z, A-Z, @ and _,
+// with letters case insensitive up to base 36.
+func arithDigit(ch byte, base int) int {
+	switch {
+	case isDigit(ch):
+		return int(ch - '0')
+	case ch >= 'a' && ch <= 'z':
+		return int(ch-'a') + 10
+	case ch >= 'A' && ch <= 'Z':
+		if base <= 36 {
+			return int(ch-'A') + 10
+		}
+		return int(ch-'A') + 36
+	case ch == '@':
+		return 62
+	case ch == '_':
+		return 63
+	}
+	return -1
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,335 @@
+package main
+
+// The syntax tree the parser builds from the input. Every node records the
+// position it starts at, which is what syntax errors point at.
+
+type Node interface {
+	Pos() Pos
+}
+
+// List is a sequence of and-or lists separated by ';', '&' or newlines, like
+// a whole command line or the body of a compound command.
+type List struct {
+	Items []*AndOr
+}
+
+// AndOr is a chain of pipelines joined by "&&" and "||". Terminated by '&'
+// it's run in the background as a job, which is shown as its Source.
+type AndOr struct {
+	Pipelines  []*Pipeline
+	Ops        []string // Ops[i] joins Pipelines[i] and Pipelines[i+1]
+	Background bool
+	Source     string
+}
+
+func (n *AndOr) Pos() Pos { return n.Pipelines[0].Pos() }
+
+// Pipeline is a sequence of commands joined by '|'. Negated inverts its exit
+// status, `! pipeline`, and Timed reports the time it took, `time [-p]
+// pipeline`, in the POSIX format with Posix. A timed pipeline may have no
+// commands, timing nothing. Source is shown when it's stopped and becomes a
+// job.
+type Pipeline struct {
+	Position Pos
+	Cmds     []Command
+	Negated  bool
+	Timed    bool
+	Posix    bool
+	Source   string
+}
+
+func (n *Pipeline) Pos() Pos { return n.Position }
+
+// Command is either a simple command or a compound command.
+type Command interface {
+	Node
+	command()
+}
+
+// SimpleCmd is a command name with its arguments and redirections, preceded
+// by variable assignments.
+type SimpleCmd struct {
+	Position Pos
+	Assigns  []*Assign
+	Args     []*Word
+	Redirs   []*Redirect
+}
+
+func (n *SimpleCmd) Pos() Pos { return n.Position }
+func (n *SimpleCmd) command() {}
+
+// Assign is a variable assignment `name=value`.
+type Assign struct {
+	Position Pos
+	Name     string
+	Value    *Word
+}
+
+func (n *Assign) Pos() Pos { return n.Position }
+
+// ArithCmd is the arithmetic command `((expr))`.
+type ArithCmd struct {
+	Position Pos
+	Expr     *Word
+}
+
+func (n *ArithCmd) Pos() Pos { return n.Position }
+func (n *ArithCmd) command() {}
+
+// IfClause is `if cond; then list; [elif cond; then list;]... [else list;] fi`.
+// An elif is another IfClause in Else and an else one without a Cond.
+type IfClause struct {
+	Position Pos
+	Cond     *List
+	Then     *List
+	Else     *IfClause
+	Redirs   []*Redirect
+}
+
+func (n *IfClause) Pos() Pos { return n.Position }
+func (n *IfClause) command() {}
+
+// WhileClause is `while cond; do list; done`, or `until cond; do list; done`
+// which loops as long as cond fails.
+type WhileClause struct {
+	Position Pos
+	Until    bool
+	Cond     *List
+	Body     *List
+	Redirs   []*Redirect
+}
+
+func (n *WhileClause) Pos() Pos { return n.Position }
+func (n *WhileClause) command() {}
+
+// ForClause is `for name in words; do list; done`. Without `in`, Words is
+// nil and the loop runs over the positional parameters.
+type ForClause struct {
+	Position Pos
+	Name     string
+	Words    []*Word
+	Body     *List
+	Redirs   []*Redirect
+}
+
+func (n *ForClause) Pos() Pos { return n.Position }
+func (n *ForClause) command() {}
+
+// ArithForClause is `for ((init; cond; post)); do list; done`. Each of the
+// expressions may be empty.
+type ArithForClause struct {
+	Position Pos
+	Init     *Word
+	Cond     *Word
+	Post     *Word
+	Body     *List
+	Redirs   []*Redirect
+}
+
+func (n *ArithForClause) Pos() Pos { return n.Position }
+func (n *ArithForClause) command() {}
+
+// Subshell is `( list )`, which runs list in a subshell environment.
+type Subshell struct {
+	Position Pos
+	Body     *List
+	Redirs   []*Redirect
+}
+
+func (n *Subshell) Pos() Pos { return n.Position }
+func (n *Subshell) command() {}
+
+// BraceGroup is `{ list; }`, which runs list in the current shell.
+type BraceGroup struct {
+	Position Pos
+	Body     *List
+	Redirs   []*Redirect
+}
+
+func (n *BraceGroup) Pos() Pos { return n.Position }
+func (n *BraceGroup) command() {}
+
+// FuncDecl is a function definition `name() body` or `function name body`.
+// The body is a compound command, usually a brace group, and the
+// redirections attached to it apply whenever the function is called.
+type FuncDecl struct {
+	Position Pos
+	Name     string
+	Body     Command
+}
+
+func (n *FuncDecl) Pos() Pos { return n.Position }
+func (n *FuncDecl) command() {}
+
+// CaseClause is `case word in [(]pattern[|pattern]...) list;; ... esac`.
+type CaseClause struct {
+	Position Pos
+	Word     *Word
+	Items    []*CaseItem
+	Redirs   []*Redirect
+}
+
+func (n *CaseClause) Pos() Pos { return n.Position }
+func (n *CaseClause) command() {}
+
+// CaseItem is a single item of a case clause. Op is what follows its list:
+// ";;" ends the case clause, ";&" runs the list of the next item as well and
+// ";;&" goes on matching the next items.
+type CaseItem struct {
+	Patterns []*Word
+	Body     *List
+	Op       string
+}
+
+// Redirect is a redirection operator applied to fd. For here-documents
+// Heredoc holds the body and Target the delimiter.
+type Redirect struct {
+	Position Pos
+	Op       string
+	Fd       int
+	Target   *Word
+	Heredoc  *Word
+}
+
+func (n *Redirect) Pos() Pos { return n.Position }
+
+// Word is a single shell word made of literal, quoted and expansion parts.
+type Word struct {
+	Position Pos
+	Parts    []WordPart
+}
+
+func (n *Word) Pos() Pos { return n.Position }
+
+// WordPart is a piece of a word.
+type WordPart interface {
+	wordPart()
+}
+
+// Lit is unquoted literal text.
+type Lit struct {
+	Value string
+}
+
+// SglQuoted is text taken literally: single quoted or escaped with a
+// backslash.
+type SglQuoted struct {
+	Value string
+}
+
+// DblQuoted is a double quoted part of a word, which may contain expansions.
+type DblQuoted struct {
+	Parts []WordPart
+}
+
+// ParamExp is a parameter expansion, either `$name` or `${...}`. Op is one
+// of the operators applying Word to the value of the parameter: "-", "=",
+// "?", "+", each optionally prefixed with ':', or "#", "##", "%", "%%".
+// Index is the subscript of an array element, `${name[index]}`, expanded
+// like an arithmetic expression unless it's "@" or "*".
+type ParamExp struct {
+	Name   string
+	Braced bool
+	Length bool // ${#name}
+	Index  *Word
+	Op     string
+	Word   *Word
+}
+
+func (p *ParamExp) String() string {
+	if !p.Braced {
+		return "$" + p.Name
+	}
+	s := "${"
+	if p.Length {
+		s += "#"
+	}
+	s += p.Name
+	if p.Index != nil {
+		index, _ := p.Index.unquoted()
+		s += "[" + index + "]"
+	}
+	s += p.Op
+	if p.Word != nil {
+		w, _ := p.Word.unquoted()
+		s += w
+	}
+	return s + "}"
+}
+
+// CmdSubst is a command substitution, `$(...)` or the backquoted form.
+// Source is the text between the delimiters.
+type CmdSubst struct {
+	Body       *List
+	Source     string
+	Backquoted bool
+}
+
+func (p *CmdSubst) String() string {
+	if p.Backquoted {
+		return "`" + p.Source + "`"
+	}
+	return "$(" + p.Source + ")"
+}
+
+// ArithExp is an arithmetic expansion `$((expr))`. Expr is expanded like a
+// double quoted string before it's evaluated.
+type ArithExp struct {
+	Expr *Word
+}
+
+func (p *ArithExp) String() string {
+	expr, _ := p.Expr.unquoted()
+	return "$((" + expr + "))"
+}
+
+func (*Lit) wordPart()       {}
+func (*SglQuoted) wordPart() {}
+func (*DblQuoted) wordPart() {}
+func (*ParamExp) wordPart()  {}
+func (*CmdSubst) wordPart()  {}
+func (*ArithExp) wordPart()  {}
+
+// lit returns the value of a word consisting of unquoted literal text only,
+// which is the case for reserved words.
+func (w *Word) lit() (string, bool) {
+	if len(w.Parts) != 1 {
+		return "", false
+	}
+	l, ok := w.Parts[0].(*Lit)
+	if !ok {
+		return "", false
+	}
+	return l.Value, true
+}
+
+// unquoted returns the text of the word with its quotes removed and whether
+// any part of it was quoted. No expansions are performed.
+func (w *Word) unquoted() (string, bool) {
+	var sb []byte
+	quoted := false
+
+	var walk func(parts []WordPart)
+	walk = func(parts []WordPart) {
+		for _, part := range parts {
+			switch p := part.(type) {
+			case *Lit:
+				sb = append(sb, p.Value...)
+			case *SglQuoted:
+				sb = append(sb, p.Value...)
+				quoted = true
+			case *DblQuoted:
+				walk(p.Parts)
+				quoted = true
+			case *ParamExp:
+				sb = append(sb, p.String()...)
+			case *CmdSubst:
+				sb = append(sb, p.String()...)
+			case *ArithExp:
+				sb = append(sb, p.String()...)
+			}
+		}
+	}
+	walk(w.Parts)
+	return string(sb), quoted
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// braceItem is either a single unquoted character of a word or a part of it
+// that brace expansion leaves alone, like quoted text or a parameter.
+type braceItem struct {
+	ch   rune
+	part WordPart // nil for a character
+}
+
+func (item braceItem) is(ch rune) bool {
+	return item.part == nil && item.ch == ch
+}
+
+// braceExpand expands the brace expressions of a word, `{a,b}` and the
+// sequences `{x..y[..step]}`, into the words they stand for. Brace expansion
+// comes before every other expansion and only unquoted braces take part in
+// it.
+func braceExpand(word *Word) []*Word {
+	var items []braceItem
+	hasBrace := false
+	for _, part := range word.Parts {
+		lit, ok := part.(*Lit)
+		if !ok {
+			items = append(items, braceItem{part: part})
+			continue
+		}
+		for _, ch := range lit.Value {
+			items = append(items, braceItem{ch: ch})
+			hasBrace = hasBrace || ch == '{'
+		}
+	}
+	if !hasBrace {
+		return []*Word{word}
+	}
+
+	var words []*Word
+	for _, expanded := range expandBraceItems(items) {
+		words = append(words, braceWord(word.Position, expanded))
+	}
+	return words
+}
+
+func expandBraceItems(items []braceItem) [][]braceItem {
+	for open := range items {
+		if !items[open].is('{') {
+			continue
+		}
+		end := matchingBrace(items, open)
+		if end < 0 {
+			continue
+		}
+
+		alternatives := braceAlternatives(items[open+1 : end])
+		if alternatives == nil {
+			// not a brace expression, e.g. `{a}`, look for one further on
+			continue
+		}
+
+		prefix := items[:open]
+		suffixes := expandBraceItems(items[end+1:])
+		var expanded [][]braceItem
+		for _, alternative := range alternatives {
+			for _, alt := range expandBraceItems(alternative) {
+				for _, suffix := range suffixes {
+					var result []braceItem
+					result = append(result, prefix...)
+					result = append(result, alt...)
+					result = append(result, suffix...)
+					expanded = append(expanded, result)
+				}
+			}
+		}
+		return expanded
+	}
+	return [][]braceItem{items}
+}
+
+// matchingBrace returns the index of the '}' closing the '{' at open, or -1.
+func matchingBrace(items []braceItem, open int) int {
+	depth := 0
+	for i := open; i < len(items); i++ {
+		switch {
+		case items[i].is('{'):
+			depth++
+		case items[i].is('}'):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// braceAlternatives returns the alternatives of the body of a brace
+// expression, split at the commas outside of nested braces, or else the
+// elements of a sequence. It returns nil if body is neither.
+func braceAlternatives(body []braceItem) [][]braceItem {
+	var alternatives [][]braceItem
+	depth := 0
+	start := 0
+	for i, item := range body {
+		switch {
+		case item.is('{'):
+			depth++
+		case item.is('}'):
+			depth--
+		case item.is(',') && depth == 0:
+			alternatives = append(alternatives, body[start:i])
+			start = i + 1
+		}
+	}
+	if alternatives != nil {
+		return append(alternatives, body[start:])
+	}
+
+	var sb strings.Builder
+	for _, item := range body {
+		if item.part != nil {
+			return nil
+		}
+		sb.WriteRune(item.ch)
+	}
+	for _, s := range braceSequence(sb.String()) {
+		var alternative []braceItem
+		for _, ch := range s {
+			alternative = append(alternative, braceItem{ch: ch})
+		}
+		alternatives = append(alternatives, alternative)
+	}
+	return alternatives
+}
+
+// braceSequence returns the elements of a sequence expression `x..y[..step]`
+// between either integers or single characters. Integers are zero padded to
+// the same width if either end is.
+func braceSequence(body string) []string {
+	ends := strings.Split(body, "..")
+	if len(ends) != 2 && len(ends) != 3 {
+		return nil
+	}
+
+	step := 1
+	if len(ends) == 3 {
+		n, err := strconv.Atoi(ends[2])
+		if err != nil {
+			return nil
+		}
+		if n < 0 {
+			n = -n
+		}
+		if n < 0 {
+			// the negated minimum doesn't fit
+			return nil
+		}
+		if n != 0 {
+			step = n
+		}
+	}
+
+	var seq []string
+	x, errX := strconv.Atoi(ends[0])
+	y, errY := strconv.Atoi(ends[1])
+	if errX == nil && errY == nil {
+		width := 0
+		if zeroPadded(ends[0]) || zeroPadded(ends[1]) {
+			width = max(len(ends[0]), len(ends[1]))
+		}
+		for _, n := range sequence(x, y, step) {
+			seq = append(seq, fmt.Sprintf("%0*d", width, n))
+		}
+		return seq
+	}
+
+	from, to := []rune(ends[0]), []rune(ends[1])
+	if len(from) != 1 || len(to) != 1 || !isLetter(from[0]) || !isLetter(to[0]) {
+		return nil
+	}
+	for _, n := range sequence(int(from[0]), int(to[0]), step) {
+		seq = append(seq, string(rune(n)))
+	}
+	return seq
+}
+
+// maxSequence is the most elements a sequence expression expands to, any
+// longer one is left as it is.
+const maxSequence = 1 << 20
+
+// sequence counts from x to y, downwards if y is less than x. It returns nil
+// if there are more than maxSequence numbers.
+func sequence(x int, y int, step int) []int {
+	// the distance between the ends doesn't overflow as an unsigned number
+	span, down := uint64(y)-uint64(x), x > y
+	if down {
+		span = uint64(x) - uint64(y)
+	}
+	count := span/uint64(step) + 1
+	if count > maxSequence {
+		return nil
+	}
+
+	if down {
+		step = -step
+	}
+	seq := make([]int, count)
+	for i := range seq {
+		seq[i] = x + i*step
+	}
+	return seq
+}
+
+func zeroPadded(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return len(s) > 1 && s[0] == '0'
+}
+
+func isLetter(ch rune) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+// braceWord turns items back into a word, merging the characters into
+// literal parts.
+func braceWord(pos Pos, items []braceItem) *Word {
+	word := &Word{Position: pos}
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			word.Parts = append(word.Parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for _, item := range items {
+		if item.part == nil {
+			lit.WriteRune(item.ch)
+			continue
+		}
+		flush()
+		word.Parts = append(word.Parts, item.part)
+	}
+	flush()
+	return word
+}
@@ -5,12 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 )
 
 const (
@@ -20,172 +27,436 @@ const (
 )
 
 const (
-	EXIT = "exit"
-	ECHO = "echo"
-	TYPE = "type"
-	PWD  = "pwd"
-	CD   = "cd"
+	EXIT     = "exit"
+	ECHO     = "echo"
+	TYPE     = "type"
+	PWD      = "pwd"
+	CD       = "cd"
+	SHOPT    = "shopt"
+	LET      = "let"
+	EXPORT   = "export"
+	UNSET    = "unset"
+	READONLY = "readonly"
+	BREAK    = "break"
+	CONTINUE = "continue"
+	LOCAL    = "local"
+	RETURN   = "return"
+	JOBS     = "jobs"
+	FG       = "fg"
+	BG       = "bg"
+	WAIT     = "wait"
+	DISOWN   = "disown"
+	SET      = "set"
 )
 
-var builtins [5]string = [5]string{EXIT, ECHO, TYPE, PWD, CD}
+var builtins = [...]string{EXIT, ECHO, TYPE, PWD, CD, SHOPT, LET, EXPORT, UNSET, READONLY, BREAK, CONTINUE, LOCAL, RETURN, JOBS, FG, BG, WAIT, DISOWN, SET}
 
+// Shell executes syntax trees and keeps the state shared between command
+// lines.
 type Shell struct {
-	cmds    []*exec.Cmd
-	builtin []Token
+	ctx    context.Context
+	status int                 // exit status of the last pipeline, `$?`
+	vars   map[string]variable // shell variables, the exported ones make up the environment
+	shopts map[string]bool     // options set with `shopt`
+	opts   map[string]bool     // options set with `set -o`
+	substs int                 // number of command substitutions run, see runPipeline
+	args   []string            // positional parameters, `$1`...
+	funcs  map[string]*FuncDecl
+
+	// dir is the working directory, which relative paths are resolved
+	// against and commands are started in. Subshells run in the same
+	// process, so it's never made the working directory of the process.
+	dir string
+
+	// locals holds a frame for each function being run, with the values
+	// the variables it declared local had before
+	locals []map[string]variable
+
+	// loops is the number of loops being run, breaks and continues the
+	// number of them left to unwind by a pending `break n` or `continue n`
+	loops     int
+	breaks    int
+	continues int
+	returning bool // a `return` is leaving the lists of a function body
+
+	// sigint delivers Ctrl+C while commands run, so that loops of builtins
+	// can be interrupted too
+	sigint chan os.Signal
+
+	jobs  *jobTable
+	job   *job       // the job the shell runs the commands of, nil in the foreground
+	group *procGroup // the process group of the pipeline or job the shell is part of, if any
+	timer *cpuUsage  // adds up the CPU time of the processes of the pipeline being timed, if any
+
+	// with job control every pipeline run in the foreground is given the
+	// terminal tty, the shell being process group pgid otherwise
+	jobControl bool
+	tty        int
+	pgid       int
+	ttyState   *term.State // the terminal modes of the shell
+
+	// the streams commands are run with before their redirections
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
 }
 
-func NewShell(sets [][]Token, ctx context.Context) (*Shell, error) {
-	shell := &Shell{
-		cmds:    nil,
-		builtin: nil,
+func NewShell(ctx context.Context) *Shell {
+	dir, _ := os.Getwd()
+	return &Shell{
+		ctx:    ctx,
+		status: 0,
+		vars:   environVars(),
+		funcs:  map[string]*FuncDecl{},
+		dir:    dir,
+		shopts: map[string]bool{
+			"failglob": false, // a pattern without matches fails the command
+			"nullglob": false, // a pattern without matches expands to nothing
+		},
+		opts: map[string]bool{
+			"pipefail": false, // a pipeline fails if any of its commands does
+		},
+		jobs:   &jobTable{},
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
 	}
+}
 
-	// TODO: refactor to be in the loop down below
-	// check if builtin
-	if len(sets) == 1 {
-		set := sets[0]
-		if token, ok := set[0].(*LiteralToken); ok {
-			if isBuiltin(token.literal) {
-				shell.builtin = set
-				return shell, nil
-			}
-		}
-	}
+// subshell returns a copy of the shell to run commands in a subshell
+// environment, whose changes to the state don't affect the shell.
+func (shell *Shell) subshell() *Shell {
+	sub := *shell
+	sub.vars = maps.Clone(shell.vars)
+	sub.funcs = maps.Clone(shell.funcs)
+	sub.locals = nil
+	for _, frame := range shell.locals {
+		sub.locals = append(sub.locals, maps.Clone(frame))
+	}
+	sub.shopts = maps.Clone(shell.shopts)
+	sub.opts = maps.Clone(shell.opts)
+	return &sub
+}
 
-	// validate commands
-	if err := shell.validateCmds(sets); err != nil {
-		return nil, err
+// inDir returns path relative to dir, unless it's absolute.
+func inDir(dir string, path string) string {
+	if path == "" || dir == "" || filepath.IsAbs(path) {
+		return path
 	}
+	return strings.TrimSuffix(dir, "/") + "/" + path
+}
 
-	execCmds := []*exec.Cmd{}
-	for _, tokenSet := range sets {
-		execCmd, err := initCmd(ctx, tokenSet)
-		if err != nil {
-			return nil, err
+// execute runs the and-or lists of list in order. Errors failing a single
+// command are reported right away, only ExitErr is returned.
+func (shell *Shell) execute(list *List) error {
+	for _, andOr := range list.Items {
+		if andOr.Background {
+			shell.runBackground(andOr)
+			shell.status = 0
+			continue
+		}
+		if err := shell.runAndOr(andOr); err != nil {
+			return err
+		}
+		if shell.interrupted() || shell.unwinding() {
+			// interrupted with Ctrl+C: abandon the rest of the list
+			return nil
 		}
-		execCmds = append(execCmds, execCmd)
 	}
+	return nil
+}
 
-	shell.cmds = execCmds
-	return shell, nil
+// interrupted reports whether the last pipeline was interrupted with Ctrl+C
+// or stopped with Ctrl+Z.
+func (shell *Shell) interrupted() bool {
+	return isInterrupt(shell.status)
 }
 
-func redirectFd(redirectToken RedirectToken, filePath string) (*os.File, error) {
-	// TODO: do we validate the fd value?
-	switch redirectToken.op {
-	case ">":
-		if err := mkParentDirIfAbsent(filePath); err != nil {
-			return nil, err
+func isInterrupt(status int) bool {
+	return status == 128+int(syscall.SIGINT) || status == 128+int(syscall.SIGTSTP)
+}
+
+// checkInterrupt reports whether Ctrl+C was pressed since the last check,
+// or a subshell in a pipeline was told to stop, setting the status
+// accordingly.
+func (shell *Shell) checkInterrupt() bool {
+	select {
+	case sig := <-shell.sigint:
+		shell.status = 128 + int(sig.(syscall.Signal))
+		return true
+	default:
+		return shell.interrupted()
+	}
+}
+
+// drainInterrupts forgets about Ctrl+C pressed before, e.g. to kill the
+// last command of the previous command line.
+func (shell *Shell) drainInterrupts() {
+	for {
+		select {
+		case <-shell.sigint:
+		default:
+			return
 		}
-		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_EXCL|os.O_CREATE, 0644)
-		if errors.Is(err, os.ErrExist) {
-			return nil, err
+	}
+}
+
+// runAndOr runs the pipelines of an and-or list in order, skipping the ones
+// whose "&&" or "||" condition isn't met by the status of the pipeline run
+// last.
+func (shell *Shell) runAndOr(andOr *AndOr) error {
+	for i, pipeline := range andOr.Pipelines {
+		if i > 0 {
+			op := andOr.Ops[i-1]
+			if (op == "&&" && shell.status != 0) || (op == "||" && shell.status == 0) {
+				continue
+			}
 		}
+
+		var err error
+		shell.status, err = shell.runPipeline(pipeline)
 		if err != nil {
-			panic(err) // FIXME: any other relevant errors?
+			return err
 		}
+		if shell.interrupted() || shell.unwinding() {
+			return nil
+		}
+	}
+	return nil
+}
 
-		return file, nil
-	case ">|":
-		if err := mkParentDirIfAbsent(filePath); err != nil {
-			return nil, err
+// simpleCmd is a simple command with its words expanded.
+type simpleCmd struct {
+	assigns   []assignment
+	argv      []string
+	redirects []redirect
+}
+
+// stage is a command of a pipeline: a simple command with its words
+// expanded, or a compound command.
+type stage struct {
+	cmd      simpleCmd
+	compound Command // nil for a simple command
+}
+
+// external reports whether the stage runs as a process rather than in a
+// subshell in the shell process.
+func (st stage) external(shell *Shell) bool {
+	return st.compound == nil && shell.isExternal(st.cmd)
+}
+
+// runPipeline executes a pipeline and returns its exit status, inverted
+// with `!` unless it was interrupted. With `time` the time it took is
+// reported once it's done.
+func (shell *Shell) runPipeline(pipeline *Pipeline) (int, error) {
+	if pipeline.Timed {
+		defer shell.startTimer(pipeline.Posix)()
+	}
+	status, err := shell.runCmds(pipeline)
+	if pipeline.Negated && err == nil && !isInterrupt(status) {
+		status = int(boolInt(status == 0))
+	}
+	return status, err
+}
+
+// runCmds runs the commands of a pipeline and returns its exit status,
+// setting PIPESTATUS to the statuses of the commands. A compound command on
+// its own leaves that to the pipelines it runs.
+func (shell *Shell) runCmds(pipeline *Pipeline) (int, error) {
+	if len(pipeline.Cmds) == 0 {
+		return 0, nil
+	}
+	if _, ok := pipeline.Cmds[0].(*SimpleCmd); !ok && len(pipeline.Cmds) == 1 {
+		shell.jobStarted()
+		return shell.runCompound(pipeline.Cmds[0])
+	}
+
+	statuses, err := shell.runStages(pipeline)
+	values := make([]string, len(statuses))
+	for i, status := range statuses {
+		values[i] = strconv.Itoa(status)
+	}
+	_ = shell.setArray("PIPESTATUS", values)
+	return pipelineStatus(statuses, shell.opts["pipefail"]), err
+}
+
+// pipelineStatus returns the exit status of a pipeline from those of its
+// commands: the one of the last command or, with pipefail, of the rightmost
+// one failing.
+func pipelineStatus(statuses []int, pipefail bool) int {
+	if pipefail {
+		for i := len(statuses) - 1; i >= 0; i-- {
+			if statuses[i] != 0 {
+				return statuses[i]
+			}
+		}
+	}
+	return statuses[len(statuses)-1]
+}
+
+// runStages runs the commands of a pipeline that isn't a single compound
+// command and returns their exit statuses.
+func (shell *Shell) runStages(pipeline *Pipeline) ([]int, error) {
+	substs := shell.substs
+	stages := []stage{}
+	for _, cmd := range pipeline.Cmds {
+		simple, ok := cmd.(*SimpleCmd)
+		if !ok {
+			stages = append(stages, stage{compound: cmd})
+			continue
 		}
-		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0644)
+		expanded, err := shell.expandSimpleCmd(simple)
 		if err != nil {
-			panic(err) // FIXME: any relevant errors?
+			fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+			return []int{1}, nil
 		}
+		stages = append(stages, stage{cmd: expanded})
+	}
 
-		return file, nil
-	case ">>":
-		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	cmd := stages[0].cmd
+	if len(stages) > 1 || shell.isExternal(cmd) {
+		statuses, err := shell.executeCmds(pipeline, stages)
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return nil, err
+			fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+			if statuses == nil {
+				statuses = []int{exitStatus(err)}
 			} else {
-				panic(err) // FIXME: any relevant errors?
+				statuses[len(statuses)-1] = exitStatus(err)
 			}
 		}
+		return statuses, nil
+	}
 
-		return file, nil
-	default:
-		return nil, UnknownOperatorErr
+	shell.jobStarted()
+	status, err := shell.runSimple(cmd)
+	if errors.Is(err, ExitErr) {
+		return []int{status}, err
 	}
+	if err != nil {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+	}
+	if len(cmd.argv) == 0 && status == 0 && shell.substs != substs {
+		// the status of the last command substitution, e.g. `out=$(cmd)`
+		status = shell.status
+	}
+	return []int{status}, nil
 }
 
-func mkParentDirIfAbsent(path string) error {
-	dir := filepath.Dir(path)
-	_, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		err := os.MkdirAll(dir, 0750)
-		if err != nil {
-			return err
+// runSimple runs a simple command in the shell process: a function, which
+// comes before builtins and commands on the PATH, a builtin or a command
+// without a name. The streams of the shell are redirected while it runs.
+func (shell *Shell) runSimple(cmd simpleCmd) (int, error) {
+	if len(cmd.argv) == 0 {
+		// assignments without a command are there to stay
+		if err := shell.assign(cmd.assigns); err != nil {
+			return 1, err
 		}
+		return shell.redirectOnly(cmd.redirects)
 	}
-	return nil
+
+	return shell.withAssigns(cmd.assigns, func() (int, error) {
+		return shell.withStreams(cmd.redirects, func() (int, error) {
+			if fn := shell.funcs[cmd.argv[0]]; fn != nil {
+				return shell.callFunc(fn, cmd.argv)
+			}
+			return shell.runBuiltin(cmd.argv)
+		})
+	})
+}
+
+// runArithCmd evaluates `((expr))`, which succeeds if expr is non-zero.
+func (shell *Shell) runArithCmd(cmd *ArithCmd) int {
+	expr, err := shell.expandString(cmd.Expr)
+	if err != nil {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+		return 1
+	}
+	n, err := shell.evalArith(expr)
+	if err != nil {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+		return 1
+	}
+	return int(boolInt(n == 0))
 }
 
-func (shell *Shell) runBuiltin() error {
-	token := (*shell).builtin[0]
-	t, ok := token.(*LiteralToken)
-	if !ok {
-		return fmt.Errorf("expected builtin, got %s", token.String())
+// redirectOnly performs the redirections of a command without a name, which
+// creates or truncates files but does nothing else.
+func (shell *Shell) redirectOnly(redirects []redirect) (int, error) {
+	fds := newFdTable(shell.dir, shell.stdin, shell.stdout, shell.stderr)
+	defer fds.close()
+	if err := fds.applyAll(redirects); err != nil {
+		return 1, err
 	}
+	return 0, nil
+}
 
-	switch t.literal {
+func (shell *Shell) runBuiltin(argv []string) (int, error) {
+	switch argv[0] {
 	case EXIT:
 		// TODO: call original binary instead of doing builtin
 		// graceful shutdown with cancel context instead of killing with no defers run
-		if err := shell.exit(); err == nil {
-			return ExitErr
-		}
+		return shell.exit(argv)
 	case ECHO:
-		shell.echo()
+		return shell.echo(argv), nil
 	case TYPE:
-		shell.typeCommand()
+		return shell.typeCommand(argv), nil
 	case PWD:
-		shell.pwd()
+		return shell.pwd(), nil
 	case CD:
-		if err := shell.cd(); err != nil {
-			return err
+		if err := shell.cd(argv); err != nil {
+			fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+			return 1, nil
 		}
-	}
-	return nil
+	case SHOPT:
+		return shell.shopt(argv), nil
+	case LET:
+		return shell.let(argv), nil
+	case EXPORT:
+		return shell.export(argv), nil
+	case UNSET:
+		return shell.unset(argv), nil
+	case READONLY:
+		return shell.readonly(argv), nil
+	case BREAK, CONTINUE:
+		return shell.loopControl(argv), nil
+	case LOCAL:
+		return shell.local(argv), nil
+	case RETURN:
+		return shell.returnFunc(argv), nil
+	case JOBS:
+		return shell.listJobs(argv), nil
+	case FG:
+		return shell.fg(argv), nil
+	case BG:
+		return shell.bg(argv), nil
+	case WAIT:
+		return shell.wait(argv), nil
+	case DISOWN:
+		return shell.disown(argv), nil
+	case SET:
+		return shell.set(argv), nil
+	}
+	return 0, nil
 }
 
-func (shell *Shell) validateCmds(cmds [][]Token) error {
-	// 1. check path if exists
-	// 2. set redirections if applicable
-	// redirectionOps := []string{">", ">|", ">>"}
-
-	for _, cmd := range cmds {
-		tok, ok := cmd[0].(*LiteralToken)
-		if !ok {
-			return errors.New(fmt.Sprintf("expected binary name, got %s", stringify(cmd)))
+func (shell *Shell) validateCmds(stages []stage) error {
+	for _, st := range stages {
+		cmd := st.cmd
+		if st.compound != nil || !shell.isExternal(cmd) {
+			continue
 		}
-		bin := tok.literal
-		_, err := exec.LookPath(bin)
-		if err != nil {
-			if errors.Is(err, exec.ErrDot) {
-				return err
-			} else {
-				return NewNotFoundError(bin)
-			}
+		if _, err := shell.lookPath(cmd.argv[0], cmd.assigns); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func stringify(lst []Token) string {
-	var sb strings.Builder
-	for i, arg := range lst {
-		sb.WriteString(arg.String())
-
-		if i < len(lst)-1 {
-			sb.WriteString(" ")
-		}
-	}
-	return sb.String()
+// isExternal reports whether cmd is run as a process rather than by the
+// shell.
+func (shell *Shell) isExternal(cmd simpleCmd) bool {
+	return len(cmd.argv) > 0 && shell.funcs[cmd.argv[0]] == nil && !isBuiltin(cmd.argv[0])
 }
 
 func isBuiltin(str string) bool {
@@ -197,36 +468,8 @@ func isBuiltin(str string) bool {
 	return false
 }
 
-func (shell *Shell) echo() {
-	cmd := shell.builtin
+func (shell *Shell) echo(argv []string) int {
 	var sb strings.Builder
-	var err error
-	openFile := os.Stdout
-	fd := STDOUT
-
-	argv := []string{}
-	for i := 0; i < len(cmd); {
-		token := cmd[i]
-
-		switch t := token.(type) {
-		case *LiteralToken:
-			argv = append(argv, t.literal)
-			i++
-		case *RedirectToken:
-			pathTok, ok := cmd[i+1].(*LiteralToken)
-			if !ok {
-				fmt.Fprintf(os.Stderr, "Expected literalToken for path, got %s\n", cmd[i+1].String())
-				return
-			}
-			openFile, err = redirectFd(*t, pathTok.literal)
-			if err != nil {
-				_ = openFile.Close()
-				return
-			}
-			fd = t.fd
-			i = i + 2
-		}
-	}
 
 	for i := 1; i < len(argv); i++ {
 		arg := argv[i]
@@ -237,237 +480,507 @@ func (shell *Shell) echo() {
 			sb.WriteString("\n")
 		}
 	}
-	switch fd {
-	case STDOUT:
-		fmt.Fprintf(openFile, sb.String())
-	case STDERR:
-		fmt.Fprintf(openFile, "")
-		fmt.Fprintf(os.Stdout, sb.String())
-	default:
-		fmt.Fprintf(openFile, sb.String())
+
+	if _, err := io.WriteString(shell.stdout, sb.String()); err != nil {
+		return shell.writeError(ECHO, err)
 	}
+	return 0
 }
 
-func (shell *Shell) exit() error {
-	cmd := shell.builtin
+// shopt sets (-s) or unsets (-u) shell options, or prints them.
+func (shell *Shell) shopt(argv []string) int {
+	out := shell.builtinStdout(SHOPT)
+
+	args := argv[1:]
+	flag := ""
+	if len(args) > 0 && (args[0] == "-s" || args[0] == "-u" || args[0] == "-p") {
+		flag = args[0]
+		args = args[1:]
+	} else if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		fmt.Fprintf(shell.stderr, "shopt: %s: invalid option\n", args[0])
+		fmt.Fprintln(shell.stderr, "shopt: usage: shopt [-s|-u|-p] [optname ...]")
+		return 2
+	}
+
+	names := args
+	if len(names) == 0 {
+		if flag == "-s" || flag == "-u" {
+			// list the options that are set or unset respectively
+			for _, name := range optionNames(shell.shopts) {
+				if shell.shopts[name] == (flag == "-s") {
+					fmt.Fprintf(out, "%-15s\t%s\n", name, onOff(shell.shopts[name]))
+				}
+			}
+			return 0
+		}
+		names = optionNames(shell.shopts)
+	}
+
+	status := 0
+	for _, name := range names {
+		set, ok := shell.shopts[name]
+		if !ok {
+			fmt.Fprintf(shell.stderr, "shopt: %s: invalid shell option name\n", name)
+			status = 1
+			continue
+		}
+
+		switch flag {
+		case "-s", "-u":
+			shell.shopts[name] = flag == "-s"
+		case "-p":
+			if set {
+				fmt.Fprintf(out, "shopt -s %s\n", name)
+			} else {
+				fmt.Fprintf(out, "shopt -u %s\n", name)
+			}
+		default:
+			fmt.Fprintf(out, "%-15s\t%s\n", name, onOff(set))
+			if !set && len(args) > 0 {
+				status = 1
+			}
+		}
+	}
+	return status
+}
 
-	if len(cmd) != 2 {
-		fmt.Fprintf(os.Stderr, "%s\n", notFound(stringify(cmd)))
-		return NewNotFoundError(stringify(cmd))
+// optionNames returns the names of the options of `shopt` or `set` in
+// order.
+func optionNames(opts map[string]bool) []string {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
 	}
-	t, ok := cmd[1].(*LiteralToken)
-	if !ok {
-		return fmt.Errorf("Expected int, got %s", cmd[1].String())
+	slices.Sort(names)
+	return names
+}
+
+// set turns the options given with -o on, or off with +o, and makes the
+// arguments after -- the positional parameters. `set -o` alone lists the
+// options and `set +o` the commands setting them as they are.
+func (shell *Shell) set(argv []string) int {
+	out := shell.builtinStdout(SET)
+	args := argv[1:]
+	if len(args) == 1 && (args[0] == "-o" || args[0] == "+o") {
+		for _, name := range optionNames(shell.opts) {
+			switch {
+			case args[0] == "-o":
+				fmt.Fprintf(out, "%-15s\t%s\n", name, onOff(shell.opts[name]))
+			case shell.opts[name]:
+				fmt.Fprintf(out, "set -o %s\n", name)
+			default:
+				fmt.Fprintf(out, "set +o %s\n", name)
+			}
+		}
+		return 0
 	}
-	exitStatus, err := strconv.Atoi(t.literal)
 
-	if err != nil || exitStatus != 0 {
-		fmt.Fprintf(os.Stderr, "%s\n", notFound(stringify(cmd)))
-		return NewNotFoundError(stringify(cmd))
+	status := 0
+	for len(args) > 0 {
+		flag := args[0]
+		if flag == "--" {
+			shell.args = args[1:]
+			break
+		}
+		if (flag != "-o" && flag != "+o") || len(args) < 2 {
+			fmt.Fprintf(shell.stderr, "set: %s: invalid option\n", flag)
+			fmt.Fprintln(shell.stderr, "set: usage: set [-o option-name] [+o option-name] [-- arg ...]")
+			return 2
+		}
+		name := args[1]
+		args = args[2:]
+		if _, ok := shell.opts[name]; !ok {
+			fmt.Fprintf(shell.stderr, "set: %s: invalid option name\n", name)
+			status = 1
+			continue
+		}
+		shell.opts[name] = flag == "-o"
 	}
+	return status
+}
 
-	return nil
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
 }
 
-func (shell *Shell) typeCommand() {
-	cmd := shell.builtin
+// let evaluates each argument as an arithmetic expression and succeeds if
+// the last one is non-zero.
+func (shell *Shell) let(argv []string) int {
+	if len(argv) < 2 {
+		fmt.Fprintln(shell.stderr, "let: expression expected")
+		return 1
+	}
 
-	for _, token := range cmd[1:] {
-		t, ok := token.(*LiteralToken)
-		if !ok {
-			fmt.Fprintf(os.Stderr, "Expected literalToken as arg, got %s\n", token.String())
+	var n int64
+	for _, expr := range argv[1:] {
+		var err error
+		if n, err = shell.evalArith(expr); err != nil {
+			fmt.Fprintf(shell.stderr, "let: %s\n", err.Error())
+			return 1
 		}
+	}
+	return int(boolInt(n == 0))
+}
+
+// exit terminates the shell with the status given as argument or else the
+// status of the last pipeline.
+func (shell *Shell) exit(argv []string) (int, error) {
+	switch len(argv) {
+	case 1:
+		return shell.status, ExitErr
+	case 2:
+		exitStatus, err := strconv.Atoi(argv[1])
+		if err != nil {
+			fmt.Fprintf(shell.stderr, "exit: %s: numeric argument required\n", argv[1])
+			return 2, ExitErr
+		}
+		return exitStatus & 0xff, ExitErr
+	default:
+		fmt.Fprintln(shell.stderr, "exit: too many arguments")
+		return 1, nil
+	}
+}
+
+func (shell *Shell) typeCommand(argv []string) int {
+	out := shell.builtinStdout(TYPE)
+	status := 0
 
-		arg := t.literal
+	for _, arg := range argv[1:] {
+		if slices.Contains(reservedWords, arg) {
+			fmt.Fprintf(out, "%s is a shell keyword\n", arg)
+			continue
+		}
+		if shell.funcs[arg] != nil {
+			fmt.Fprintf(out, "%s is a function\n", arg)
+			continue
+		}
 		if ok := isBuiltin(arg); ok {
-			fmt.Fprintf(os.Stderr, fmt.Sprintf("%s is a shell builtin\n", arg))
+			fmt.Fprintf(out, "%s is a shell builtin\n", arg)
 			continue // this is different from bash for shell builtins
 		}
 
-		if path, err := exec.LookPath(arg); err == nil {
-			fmt.Fprintf(os.Stderr, "%s is %s\n", arg, path)
+		if path, err := shell.lookPath(arg, nil); err == nil {
+			fmt.Fprintf(out, "%s is %s\n", arg, path)
 		} else {
-			fmt.Fprintf(os.Stderr, "%s\n", notFound(arg))
+			fmt.Fprintf(shell.stderr, "%s\n", notFound(arg))
+			status = 1
 		}
 	}
+	return status
 }
 
-func (cmd *Shell) pwd() {
-	if path, err := os.Getwd(); err == nil {
-		fmt.Fprintf(os.Stderr, "%s\n", path)
+func (shell *Shell) pwd() int {
+	if shell.dir == "" {
+		fmt.Fprintln(shell.stderr, "pwd: error retrieving current directory")
+		return 1
+	}
+	if _, err := fmt.Fprintf(shell.stdout, "%s\n", shell.dir); err != nil {
+		return shell.writeError(PWD, err)
 	}
+	return 0
 }
 
-func (shell *Shell) cd() error {
+func (shell *Shell) cd(argv []string) error {
 	var absPath string
 
-	cmd := shell.builtin
-	t, ok := cmd[1].(*LiteralToken)
-	if !ok {
-		fmt.Fprintf(os.Stderr, "Expected literalToken as arg, got %s\n", cmd[1].String())
+	var path string
+	if len(argv) > 1 {
+		path = argv[1]
+	} else {
+		// a tilde in the argument is expanded with the other words
+		home, ok := shell.lookupParam("HOME")
+		if !ok || home == "" {
+			return errors.New("cd: HOME not set")
+		}
+		path = home
 	}
 
-	path := t.literal
 	if invalidPath, err := regexp.Match(".*[\\.]{3,}.*", []byte(path)); err == nil && invalidPath {
 		return fmt.Errorf("cd: %s: No such file or directory", absPath)
 	}
 
-	if strings.HasPrefix(path, "~") {
-		home := os.Getenv("HOME")
-		if len(path) == 0 {
-			return errors.New("Failed to access HOME environment variable")
-		}
-		path = filepath.Join(home, path[1:])
-	}
-
 	if filepath.IsAbs(path) {
-		absPath = path
+		absPath = filepath.Clean(path)
 	} else {
-		cwd, err := os.Getwd()
-		if err != nil {
+		if shell.dir == "" {
 			return errors.New("Failed to fetch current working directory")
 		}
-		absPath = filepath.Join(cwd, path)
+		absPath = filepath.Join(shell.dir, path)
 	}
 
-	if err := os.Chdir(absPath); err != nil {
+	if info, err := os.Stat(absPath); err != nil || !info.IsDir() {
 		return fmt.Errorf("cd: %s: No such file or directory", absPath)
 	}
-
-	if err := os.Setenv("PWD", absPath); err != nil {
-		return err
-	}
-	return nil
-}
-
-func initCmd(ctx context.Context, tokens []Token) (*exec.Cmd, error) {
-	var fd = STDOUT
-	var err error
-	var openFile *os.File
-	var argv []string
-
-	for i := 0; i < len(tokens); {
-		token := tokens[i]
-
-		switch t := token.(type) {
-		case *LiteralToken:
-			argv = append(argv, t.literal)
-			i++
-		case *RedirectToken:
-			pathTok, ok := tokens[i+1].(*LiteralToken)
-			if !ok {
-				return nil, fmt.Errorf("Expected literalToken for path, got %s\n", tokens[i+1].String())
-			}
-
-			openFile, err = redirectFd(*t, pathTok.literal)
-			if err != nil {
-				return nil, err
-			}
-			fd = t.fd
-			i = i + 2
-		}
+	if err := unix.Access(absPath, unix.X_OK); err != nil {
+		return fmt.Errorf("cd: %s: Permission denied", absPath)
 	}
+	shell.dir = absPath
 
-	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
-
-	if openFile != nil {
-		switch fd {
-		case STDIN:
-			cmd.Stdin = openFile
-		case STDOUT:
-			cmd.Stdout = openFile
-		case STDERR:
-			cmd.Stderr = openFile
-		default:
-			// TODO: handle redirection for non-std fds (also close after use!)
-			cmd.ExtraFiles = append(cmd.ExtraFiles, openFile)
+	// the previous directory for `~-`
+	if pwd, ok := shell.lookupParam("PWD"); ok {
+		if err := shell.setVar("OLDPWD", pwd); err != nil {
+			return err
 		}
 	}
-	return cmd, nil
+	return shell.setVar("PWD", absPath)
 }
 
-func executeCmd(
-	pr io.Reader,
-	pw *io.PipeWriter,
-	cmd *exec.Cmd,
-	prevCmd *exec.Cmd,
-	lastCmd bool,
-) (error, *io.PipeWriter, *io.PipeReader) {
+// initCmd prepares an external command with its redirections applied over
+// the given streams and its assignments added to the environment.
+func (shell *Shell) initCmd(cmd simpleCmd, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*exec.Cmd, *fdTable, error) {
+	fds := newFdTable(shell.dir, stdin, stdout, stderr)
+	if err := fds.applyAll(cmd.redirects); err != nil {
+		fds.close()
+		return nil, nil, err
+	}
+
+	argv := cmd.argv
+	path, err := shell.lookPath(argv[0], cmd.assigns)
+	if err != nil {
+		fds.close()
+		return nil, nil, err
+	}
+	execCmd := exec.CommandContext(shell.ctx, path, argv[1:]...)
+	execCmd.Args[0] = argv[0]
+	execCmd.Env = shell.environ(cmd.assigns)
+	execCmd.Dir = shell.dir
+	if err := fds.setup(execCmd); err != nil {
+		fds.close()
+		return nil, nil, err
+	}
+	return execCmd, fds, nil
+}
 
-	if cmd.Stdin == nil && pr != nil {
-		cmd.Stdin = pr
+// executeCmds runs a pipeline and returns the exit statuses of its commands
+// once they're done, or the status of the pipeline once it's stopped with
+// job control. External commands run as processes, the other stages in
+// subshells of their own, in goroutines.
+func (shell *Shell) executeCmds(pipeline *Pipeline, stages []stage) ([]int, error) {
+	if err := shell.validateCmds(stages); err != nil {
+		return nil, err
 	}
 
-	var nextPw *io.PipeWriter = nil
-	var nextPr *io.PipeReader = nil
-	if !lastCmd {
-		nextPr, nextPw = io.Pipe()
-		if cmd.Stdout == nil {
-			cmd.Stdout = nextPw
+	// the pipelines run by the subshells of a pipeline or job are part of
+	// its process group
+	timer := shell.timer
+	group := shell.group
+	owner := group == nil
+	if owner {
+		group = shell.newProcGroup(shell.jobControl, shell.jobControl)
+	}
+
+	// pipes are set up before any redirections so that the latter can
+	// override or duplicate them, e.g. `cmd 2>&1 | less`. Each end of a pipe
+	// belongs to a single stage: a process has a copy of its own, so the
+	// one of the shell is closed once it's started, and a subshell closes
+	// it once it's done. A stage writing to a pipe whose reader is gone
+	// gets SIGPIPE, or EPIPE in the shell process.
+	last := len(stages) - 1
+	ends := make([][]*os.File, len(stages)) // the pipe ends of each stage
+	stdins := make([]io.Reader, len(stages))
+	stdouts := make([]io.Writer, len(stages))
+	stdins[0], stdouts[last] = shell.stdin, shell.stdout
+	for i := range last {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			for _, files := range ends {
+				closeFiles(files)
+			}
+			return nil, err
 		}
-	} else {
-		if cmd.Stdout == nil {
-			cmd.Stdout = os.Stdout
+		stdouts[i], stdins[i+1] = pw, pr
+		ends[i] = append(ends[i], pw)
+		ends[i+1] = append(ends[i+1], pr)
+	}
+
+	execCmds := make([]*exec.Cmd, len(stages)) // nil for the stages run in subshells
+	subs := make([]*Shell, len(stages))        // nil for external commands
+	fdTables := make([]*fdTable, len(stages))
+	closeAll := func(from int) {
+		for i := from; i < len(stages); i++ {
+			if fdTables[i] != nil {
+				fdTables[i].close()
+			}
+			closeFiles(ends[i])
 		}
 	}
 
-	if cmd.Stderr == nil {
-		cmd.Stderr = os.Stderr
-	}
+	for i, st := range stages {
+		if !st.external(shell) {
+			sub := shell.subshell()
+			sub.stdin, sub.stdout = stdins[i], stdouts[i]
+			sub.group = group
+			sub.jobs = shell.jobs.clone()
+			sub.sigint = make(chan os.Signal, 1)
+			subs[i] = sub
+			continue
+		}
 
-	if err := cmd.Start(); err != nil {
-		return err, nil, nil
+		execCmd, fds, err := shell.initCmd(st.cmd, stdins[i], stdouts[i], shell.stderr)
+		if err != nil {
+			closeAll(0)
+			return nil, err
+		}
+		execCmds[i], fdTables[i] = execCmd, fds
+	}
+
+	// the processes are started first, so that the last one doesn't become
+	// the leader of the process group if a subshell before it starts one of
+	// its own
+	procs := make([]*proc, len(stages))
+	started := len(stages)
+	var startErr error
+	for i, cmd := range execCmds {
+		if cmd == nil {
+			continue
+		}
+		if procs[i], startErr = group.start(cmd); startErr != nil {
+			closeAll(i)
+			started = i
+			break
+		}
+		fdTables[i].close()
+		closeFiles(ends[i])
 	}
+	shell.jobStarted()
 
-	if prevCmd != nil {
+	statuses := make([]int, len(stages))
+	var running sync.WaitGroup
+	for i := range min(started, last) {
+		sub, st, files := subs[i], stages[i], ends[i]
+		if sub == nil {
+			continue
+		}
+		running.Add(1)
 		go func() {
-			// TODO: lift errors
-			_ = prevCmd.Wait()
-			if pw != nil {
-				_ = pw.Close()
-			}
+			defer running.Done()
+			statuses[i] = sub.runStage(st)
+			closeFiles(files)
 		}()
 	}
 
-	defer func() {
-		if cmd.Stdout != os.Stdout {
-			if file, ok := cmd.Stdout.(*os.File); ok {
-				_ = file.Close()
-			}
+	// wait runs the last stage if it's a subshell and waits for the others,
+	// returning the status of each
+	wait := func() ([]int, error) {
+		var err error
+		switch {
+		case startErr != nil:
+			err = startErr
+		case subs[last] != nil:
+			statuses[last] = subs[last].runStage(stages[last])
+			closeFiles(ends[last])
 		}
-		if cmd.Stderr != os.Stderr {
-			if file, ok := cmd.Stderr.(*os.File); ok {
-				_ = file.Close()
+
+		for i, p := range procs {
+			if p == nil {
+				continue
+			}
+			<-p.done
+			timer.add(p.user, p.sys)
+			statuses[i] = p.status
+			if i == last {
+				err = p.err
 			}
 		}
-	}()
+		running.Wait()
+		return statuses, err
+	}
+	if !owner {
+		// the pipeline is part of another one or a job, which is
+		// stopped as a whole
+		return shell.waitStages(wait, subs, shell.sigint)
+	}
 
-	return nil, nextPw, nextPr
+	// it's a job only once it's stopped
+	j := newJob(pipeline.Source, group)
+	pipefail := shell.opts["pipefail"]
+	var err error
+	go func() {
+		statuses, err = shell.waitStages(wait, subs, group.sigint)
+		status := pipelineStatus(statuses, pipefail)
+		if err != nil {
+			status = exitStatus(err)
+		}
+		j.finish(status)
+	}()
+	status := shell.waitForeground(j)
+	if !j.finished() {
+		return []int{status}, nil
+	}
+	return statuses, err
 }
 
-func (shell *Shell) executeCmds() error {
-	var pw *io.PipeWriter
-	var pr io.Reader = nil
-	var prevCmd *exec.Cmd
+// waitStages runs wait, which returns once the stages of a pipeline are
+// done, passing the signals received on sigint on to the subshells running
+// its stages.
+func (shell *Shell) waitStages(wait func() ([]int, error), subs []*Shell, sigint chan os.Signal) ([]int, error) {
+	var statuses []int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		statuses, err = wait()
+		close(done)
+	}()
 
-	for i, cmd := range (*shell).cmds {
-		lastCmd := i+1 == len((*shell).cmds)
-		err, nextPw, nextPr := executeCmd(pr, pw, cmd, prevCmd, lastCmd)
-		if err != nil {
-			return err
+	for {
+		select {
+		case <-done:
+			return statuses, err
+		case sig := <-sigint:
+			for _, sub := range subs {
+				if sub == nil {
+					continue
+				}
+				select {
+				case sub.sigint <- sig:
+				default:
+				}
+			}
 		}
-		pw = nextPw
-		pr = nextPr
-		prevCmd = cmd
 	}
+}
 
-	if prevCmd != nil {
-		if err := prevCmd.Wait(); err != nil {
-			var exitError *exec.ExitError
-			if errors.Is(err, exitError) {
-				return err
-			}
+// runStage runs a stage of a pipeline that isn't an external command, with
+// the shell being a subshell of its own, and returns its exit status. A
+// `cd` only changes the directory of the subshell, the stages running at
+// the same time and the processes they start keep their own.
+func (shell *Shell) runStage(st stage) int {
+	if st.compound != nil {
+		// `exit` only leaves the subshell
+		status, _ := shell.runCompound(st.compound)
+		return status
+	}
+
+	status, err := shell.runSimple(st.cmd)
+	if err != nil && !errors.Is(err, ExitErr) {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+	}
+	return status
+}
+
+// exitStatus maps the outcome of a command to its exit status: 127 if it
+// wasn't found, 126 if it couldn't be executed, 128+n if it was killed by
+// signal n.
+func exitStatus(err error) int {
+	var exitError *exec.ExitError
+	var notFound *notFoundError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitError):
+		if ws, ok := exitError.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
 		}
+		return exitError.ExitCode()
+	case errors.As(err, &notFound):
+		return 127
+	case errors.Is(err, exec.ErrDot), errors.Is(err, os.ErrPermission):
+		return 126
+	default:
+		return 1
 	}
-	return nil
 }
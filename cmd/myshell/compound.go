@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// runCompound runs a compound command on its own and returns its exit
+// status. Only ExitErr is returned, like from execute.
+func (shell *Shell) runCompound(cmd Command) (int, error) {
+	switch c := cmd.(type) {
+	case *ArithCmd:
+		return shell.runArithCmd(c), nil
+	case *IfClause:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			return shell.runIf(c)
+		})
+	case *WhileClause:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			return shell.runWhile(c)
+		})
+	case *ForClause:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			return shell.runFor(c)
+		})
+	case *ArithForClause:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			return shell.runArithFor(c)
+		})
+	case *CaseClause:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			return shell.runCase(c)
+		})
+	case *Subshell:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			return shell.subshell().runSubshell(c.Body), nil
+		})
+	case *BraceGroup:
+		return shell.withRedirects(c.Redirs, func() (int, error) {
+			err := shell.execute(c.Body)
+			return shell.status, err
+		})
+	case *FuncDecl:
+		shell.funcs[c.Name] = c
+		return 0, nil
+	}
+	fmt.Fprintf(shell.stderr, "%T: unknown command\n", cmd)
+	return 1, nil
+}
+
+// runSubshell runs list with the shell being a subshell environment and
+// returns its exit status.
+func (shell *Shell) runSubshell(list *List) int {
+	// `exit` only leaves the subshell
+	_ = shell.execute(list)
+	return shell.status
+}
+
+// withRedirects runs f with the standard streams of the shell redirected,
+// which is how the redirections of a compound command apply to every command
+// inside it.
+func (shell *Shell) withRedirects(redirs []*Redirect, f func() (int, error)) (int, error) {
+	if len(redirs) == 0 {
+		return f()
+	}
+	redirects, err := shell.expandRedirects(redirs)
+	if err != nil {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+		return 1, nil
+	}
+	return shell.withStreams(redirects, f)
+}
+
+// withStreams runs f with the standard streams of the shell redirected by
+// the expanded redirections.
+func (shell *Shell) withStreams(redirects []redirect, f func() (int, error)) (int, error) {
+	if len(redirects) == 0 {
+		return f()
+	}
+
+	var err error
+	fds := newFdTable(shell.dir, shell.stdin, shell.stdout, shell.stderr)
+	defer fds.close()
+	if err := fds.applyAll(redirects); err != nil {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+		return 1, nil
+	}
+
+	stdin, stdout, stderr := shell.stdin, shell.stdout, shell.stderr
+	defer func() {
+		shell.stdin, shell.stdout, shell.stderr = stdin, stdout, stderr
+	}()
+	if shell.stdin, err = fds.reader(STDIN); err != nil {
+		if shell.stdin, err = fds.closedFd(os.O_WRONLY); err != nil {
+			return 1, nil
+		}
+	}
+	if shell.stdout, err = fds.writer(STDOUT); err != nil {
+		if shell.stdout, err = fds.closedFd(os.O_RDONLY); err != nil {
+			return 1, nil
+		}
+	}
+	if shell.stderr, err = fds.writer(STDERR); err != nil {
+		if shell.stderr, err = fds.closedFd(os.O_RDONLY); err != nil {
+			return 1, nil
+		}
+	}
+	return f()
+}
+
+// runIf runs the list of the first branch whose condition succeeds, or the
+// else branch. Its status is that of the list run, 0 if none was.
+func (shell *Shell) runIf(clause *IfClause) (int, error) {
+	for ; clause != nil; clause = clause.Else {
+		if clause.Cond != nil {
+			if err := shell.execute(clause.Cond); err != nil {
+				return shell.status, err
+			}
+			if shell.interrupted() || shell.unwinding() {
+				return shell.status, nil
+			}
+			if shell.status != 0 {
+				continue
+			}
+		}
+		err := shell.execute(clause.Then)
+		return shell.status, err
+	}
+	return 0, nil
+}
+
+// runWhile runs the body of a while loop as long as its condition succeeds,
+// or fails for until. Its status is that of the body run last, 0 if it
+// never ran.
+func (shell *Shell) runWhile(clause *WhileClause) (int, error) {
+	shell.loops++
+	defer func() { shell.loops-- }()
+
+	status := 0
+	for {
+		if shell.checkInterrupt() {
+			return shell.status, nil
+		}
+		if err := shell.execute(clause.Cond); err != nil {
+			return shell.status, err
+		}
+		if shell.interrupted() {
+			return shell.status, nil
+		}
+		if shell.unwinding() {
+			if shell.loopDone() {
+				return shell.status, nil
+			}
+			continue
+		}
+		if (shell.status == 0) == clause.Until {
+			return status, nil
+		}
+
+		if err := shell.execute(clause.Body); err != nil {
+			return shell.status, err
+		}
+		status = shell.status
+		if shell.interrupted() || shell.loopDone() {
+			return status, nil
+		}
+	}
+}
+
+// runFor runs the body of a for loop with the variable set to each of the
+// expanded words in turn.
+func (shell *Shell) runFor(clause *ForClause) (int, error) {
+	values := shell.args
+	if clause.Words != nil {
+		values = nil
+		for _, w := range clause.Words {
+			for _, word := range braceExpand(w) {
+				fields, err := shell.expandWord(word)
+				if err != nil {
+					fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+					return 1, nil
+				}
+				values = append(values, fields...)
+			}
+		}
+	}
+
+	shell.loops++
+	defer func() { shell.loops-- }()
+
+	status := 0
+	for _, value := range slices.Clone(values) {
+		if shell.checkInterrupt() {
+			return shell.status, nil
+		}
+		if err := shell.setVar(clause.Name, value); err != nil {
+			fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+			return 1, nil
+		}
+
+		if err := shell.execute(clause.Body); err != nil {
+			return shell.status, err
+		}
+		status = shell.status
+		if shell.interrupted() || shell.loopDone() {
+			return status, nil
+		}
+	}
+	return status, nil
+}
+
+// runArithFor runs an arithmetic for loop, whose condition is true when
+// empty.
+func (shell *Shell) runArithFor(clause *ArithForClause) (int, error) {
+	shell.loops++
+	defer func() { shell.loops-- }()
+
+	if _, ok := shell.arithFor(clause.Init); !ok {
+		return 1, nil
+	}
+	status := 0
+	for {
+		if shell.checkInterrupt() {
+			return shell.status, nil
+		}
+		if len(clause.Cond.Parts) > 0 {
+			n, ok := shell.arithFor(clause.Cond)
+			if !ok {
+				return 1, nil
+			}
+			if n == 0 {
+				return status, nil
+			}
+		}
+
+		if err := shell.execute(clause.Body); err != nil {
+			return shell.status, err
+		}
+		status = shell.status
+		if shell.interrupted() || shell.loopDone() {
+			return status, nil
+		}
+
+		if _, ok := shell.arithFor(clause.Post); !ok {
+			return 1, nil
+		}
+	}
+}
+
+// arithFor evaluates one of the expressions of an arithmetic for loop,
+// reporting errors right away.
+func (shell *Shell) arithFor(expr *Word) (int64, bool) {
+	s, err := shell.expandString(expr)
+	if err == nil {
+		var n int64
+		if n, err = shell.evalArith(s); err == nil {
+			return n, true
+		}
+	}
+	fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+	return 0, false
+}
+
+// runCase runs the list of the first item with a pattern matching the word
+// and, depending on the operator ending it, the lists of the items after it.
+// Its status is that of the list run last, 0 if none was.
+func (shell *Shell) runCase(clause *CaseClause) (int, error) {
+	word, err := shell.expandString(&Word{Parts: shell.tildeExpand(clause.Word.Parts)})
+	if err != nil {
+		fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+		return 1, nil
+	}
+
+	status := 0
+	fallThrough := false
+	for _, item := range clause.Items {
+		if !fallThrough {
+			matched, err := shell.caseMatch(item, word)
+			if err != nil {
+				fmt.Fprintf(shell.stderr, "%s\n", err.Error())
+				return 1, nil
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		shell.status = 0 // an empty list succeeds
+		if err := shell.execute(item.Body); err != nil {
+			return shell.status, err
+		}
+		status = shell.status
+		if shell.interrupted() || shell.unwinding() {
+			return status, nil
+		}
+
+		switch item.Op {
+		case ";;":
+			return status, nil
+		case ";&":
+			fallThrough = true
+		case ";;&":
+			fallThrough = false
+		}
+	}
+	return status, nil
+}
+
+// caseMatch reports whether any of the patterns of item matches word. The
+// patterns are expanded in turn up to the first one matching.
+func (shell *Shell) caseMatch(item *CaseItem, word string) (bool, error) {
+	for _, p := range item.Patterns {
+		pattern, err := shell.expandPattern(shell.tildeExpand(p.Parts), false)
+		if err != nil {
+			return false, err
+		}
+		if matchPattern(pattern, word) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unwinding reports whether a `break`, `continue` or `return` is leaving
+// the lists of a loop or function body.
+func (shell *Shell) unwinding() bool {
+	return shell.breaks > 0 || shell.continues > 0 || shell.returning
+}
+
+// loopDone takes care of a pending `break` or `continue` once it reaches a
+// loop and reports whether the loop has to stop. `continue n` stops the
+// n-1 innermost loops and moves on with the next iteration of the nth.
+func (shell *Shell) loopDone() bool {
+	switch {
+	case shell.returning:
+		return true
+	case shell.breaks > 0:
+		shell.breaks--
+		return true
+	case shell.continues > 1:
+		shell.continues--
+		return true
+	case shell.continues == 1:
+		shell.continues = 0
+	}
+	return false
+}
+
+// loopControl implements `break [n]` and `continue [n]`, which only take
+// effect once the lists they're part of have unwound up to the loop.
+func (shell *Shell) loopControl(argv []string) int {
+	n := 1
+	if len(argv) > 1 {
+		var err error
+		if n, err = strconv.Atoi(argv[1]); err != nil {
+			fmt.Fprintf(shell.stderr, "%s: %s: numeric argument required\n", argv[0], argv[1])
+			return 1
+		}
+		if n < 1 {
+			fmt.Fprintf(shell.stderr, "%s: %s: loop count out of range\n", argv[0], argv[1])
+			return 1
+		}
+	}
+	if len(argv) > 2 {
+		fmt.Fprintf(shell.stderr, "%s: too many arguments\n", argv[0])
+		return 1
+	}
+	if shell.loops == 0 {
+		fmt.Fprintf(shell.stderr, "%s: only meaningful in a `for', `while', or `until' loop\n", argv[0])
+		return 0
+	}
+
+	n = min(n, shell.loops)
+	if argv[0] == BREAK {
+		shell.breaks = n
+	} else {
+		shell.continues = n
+	}
+	return 0
+}
@@ -1,11 +1,16 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 var (
 	UnknownOperatorErr = NewUnknownOperatorError()
 	UnclosedQuoteErr   = NewUnclosedQuoteError()
 	PipeHasNoTargetErr = NewPipeHasNoTargetError()
+	HeredocPendingErr  = NewHeredocPendingError()
+	CompoundPendingErr = NewCompoundPendingError()
 	ExitErr            = NewExitError()
 	SignalInterruptErr = NewSignalInterruptError()
 )
@@ -60,16 +65,37 @@ func NewPipeHasNoTargetError() error {
 	return &pipeHasNoTargetError{}
 }
 
+type heredocPendingError struct{}
+
+func (e *heredocPendingError) Error() string {
+	return "Here-document not terminated"
+}
+
+func NewHeredocPendingError() error {
+	return &heredocPendingError{}
+}
+
+type compoundPendingError struct{}
+
+func (e *compoundPendingError) Error() string {
+	return "Compound command not terminated"
+}
+
+func NewCompoundPendingError() error {
+	return &compoundPendingError{}
+}
+
 type unexpectedToken struct {
+	pos   Pos
 	token string
 }
 
 func (e *unexpectedToken) Error() string {
-	return fmt.Sprintf("Unexpected token `%s`", e.token)
+	return fmt.Sprintf("%s: Unexpected token `%s`", e.pos, e.token)
 }
 
-func NewUnexpectedTokenError(t string) error {
-	return &unexpectedToken{t}
+func NewUnexpectedTokenError(pos Pos, t string) error {
+	return &unexpectedToken{pos, t}
 }
 
 type notFoundError struct {
@@ -83,3 +109,77 @@ func (e *notFoundError) Error() string {
 func NewNotFoundError(s string) error {
 	return &notFoundError{s}
 }
+
+type badFdError struct {
+	fd int
+}
+
+func (e *badFdError) Error() string {
+	return fmt.Sprintf("%d: Bad file descriptor", e.fd)
+}
+
+func NewBadFdError(fd int) error {
+	return &badFdError{fd}
+}
+
+type ambiguousRedirectError struct {
+	target string
+}
+
+func (e *ambiguousRedirectError) Error() string {
+	return fmt.Sprintf("%s: ambiguous redirect", e.target)
+}
+
+func NewAmbiguousRedirectError(target string) error {
+	return &ambiguousRedirectError{target}
+}
+
+type badSubstitutionError struct {
+	s string
+}
+
+func (e *badSubstitutionError) Error() string {
+	return fmt.Sprintf("%s: bad substitution", e.s)
+}
+
+func NewBadSubstitutionError(s string) error {
+	return &badSubstitutionError{s}
+}
+
+type paramError struct {
+	name string
+	msg  string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("%s: %s", e.name, e.msg)
+}
+
+func NewParamError(name string, msg string) error {
+	return &paramError{name, msg}
+}
+
+type noMatchError struct {
+	pattern string
+}
+
+func (e *noMatchError) Error() string {
+	return fmt.Sprintf("no match: %s", e.pattern)
+}
+
+func NewNoMatchError(pattern string) error {
+	return &noMatchError{pattern}
+}
+
+type arithError struct {
+	expr string
+	msg  string
+}
+
+func (e *arithError) Error() string {
+	return fmt.Sprintf("%s: %s", strings.TrimSpace(e.expr), e.msg)
+}
+
+func NewArithError(expr string, msg string) error {
+	return &arithError{expr, msg}
+}
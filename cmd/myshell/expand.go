@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultIFS separates fields when IFS is unset.
+const defaultIFS = " \t\n"
+
+// expandSimpleCmd expands the words of a simple command into its arguments,
+// redirection targets and assigned values, in that order.
+func (shell *Shell) expandSimpleCmd(cmd *SimpleCmd) (simpleCmd, error) {
+	expanded := simpleCmd{}
+
+	for i, arg := range cmd.Args {
+		// the arguments of export and readonly looking like assignments
+		// are expanded like them, e.g. `export PATH=~/bin:$PATH`
+		if i > 0 && isDeclaration(expanded.argv) {
+			if assign, ok := parseAssign(arg); ok {
+				value, err := shell.expandAssign(assign)
+				if err != nil {
+					return simpleCmd{}, err
+				}
+				expanded.argv = append(expanded.argv, assign.Name+"="+value)
+				continue
+			}
+		}
+
+		for _, word := range braceExpand(arg) {
+			fields, err := shell.expandWord(word)
+			if err != nil {
+				return simpleCmd{}, err
+			}
+			expanded.argv = append(expanded.argv, fields...)
+		}
+	}
+
+	var err error
+	if expanded.redirects, err = shell.expandRedirects(cmd.Redirs); err != nil {
+		return simpleCmd{}, err
+	}
+
+	for _, assign := range cmd.Assigns {
+		value, err := shell.expandAssign(assign)
+		if err != nil {
+			return simpleCmd{}, err
+		}
+		expanded.assigns = append(expanded.assigns, assignment{name: assign.Name, value: value})
+	}
+	return expanded, nil
+}
+
+// expandRedirects expands the targets of redirections.
+func (shell *Shell) expandRedirects(redirs []*Redirect) ([]redirect, error) {
+	var redirects []redirect
+	for _, r := range redirs {
+		target, err := shell.expandRedirect(r)
+		if err != nil {
+			return nil, err
+		}
+		redirects = append(redirects, redirect{
+			op:     r.Op,
+			fd:     r.Fd,
+			target: target,
+		})
+	}
+	return redirects, nil
+}
+
+func isDeclaration(argv []string) bool {
+	return len(argv) > 0 && (argv[0] == EXPORT || argv[0] == READONLY || argv[0] == LOCAL)
+}
+
+// expandAssign expands the value of an assignment, which is neither split
+// into fields nor subject to pathname expansion. Tilde-prefixes may follow
+// any unquoted ':' as well, as in `PATH=~/bin:~/.local/bin`.
+func (shell *Shell) expandAssign(assign *Assign) (string, error) {
+	var parts []WordPart
+	for i, part := range assign.Value.Parts {
+		lit, ok := part.(*Lit)
+		if !ok {
+			parts = append(parts, part)
+			continue
+		}
+
+		segments := strings.Split(lit.Value, ":")
+		for j, segment := range segments {
+			if j > 0 {
+				parts = append(parts, &Lit{Value: ":"})
+			}
+			if i > 0 && j == 0 {
+				// continues the text of the previous part
+				parts = append(parts, &Lit{Value: segment})
+				continue
+			}
+			more := j == len(segments)-1 && i < len(assign.Value.Parts)-1
+			parts = append(parts, shell.tildePrefix(segment, more)...)
+		}
+	}
+	return shell.expandString(&Word{Position: assign.Value.Position, Parts: parts})
+}
+
+// expandRedirect expands the target of a redirection, which has to result
+// in a single field, or the body of a here-document.
+func (shell *Shell) expandRedirect(r *Redirect) (string, error) {
+	if r.Heredoc != nil {
+		return shell.expandString(r.Heredoc)
+	}
+
+	fields, err := shell.expandWord(r.Target)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) != 1 {
+		target, _ := r.Target.unquoted()
+		return "", NewAmbiguousRedirectError(target)
+	}
+	return fields[0], nil
+}
+
+// expandWord expands the tilde, parameters, command substitutions and
+// arithmetic expressions in a word, splits the result of unquoted expansions
+// into fields, replaces the fields with unquoted pattern characters by the
+// paths they match and removes the quotes.
+func (shell *Shell) expandWord(word *Word) ([]string, error) {
+	f := &fields{ifs: shell.ifs()}
+	if err := shell.expandParts(f, shell.tildeExpand(word.Parts), false, false); err != nil {
+		return nil, err
+	}
+
+	var expanded []string
+	for _, field := range f.result() {
+		if !hasGlobMeta(field.pattern) {
+			expanded = append(expanded, field.value)
+			continue
+		}
+
+		matches := glob(shell.dir, field.pattern)
+		switch {
+		case len(matches) > 0:
+			expanded = append(expanded, matches...)
+		case shell.shopts["failglob"]:
+			return nil, NewNoMatchError(field.value)
+		case shell.shopts["nullglob"]:
+		default:
+			// no match: the pattern stays as is
+			expanded = append(expanded, field.value)
+		}
+	}
+	return expanded, nil
+}
+
+// expandString expands a word the way it would be expanded in double quotes,
+// i.e. into a single string without field splitting.
+func (shell *Shell) expandString(word *Word) (string, error) {
+	f := &fields{}
+	if err := shell.expandParts(f, word.Parts, true, false); err != nil {
+		return "", err
+	}
+	return f.cur.String(), nil
+}
+
+// expandParts expands parts into f. quoted tells whether the parts are in
+// double quotes and split whether literal text is subject to field splitting,
+// which is the case for the word of an unquoted `${name:-word}`.
+func (shell *Shell) expandParts(f *fields, parts []WordPart, quoted bool, split bool) error {
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *Lit:
+			if split {
+				f.addSplit(p.Value)
+			} else {
+				f.add(p.Value, quoted)
+			}
+		case *SglQuoted:
+			f.add(p.Value, true)
+		case *DblQuoted:
+			if isAllArgs(p.Parts) && len(shell.args) == 0 {
+				// "$@" without positional parameters is no field at all
+				continue
+			}
+			f.add("", true)
+			if err := shell.expandParts(f, p.Parts, true, false); err != nil {
+				return err
+			}
+		case *ParamExp:
+			if err := shell.expandParam(f, p, quoted); err != nil {
+				return err
+			}
+		case *CmdSubst:
+			out, err := shell.commandSubst(p.Body)
+			if err != nil {
+				return err
+			}
+			if quoted {
+				f.add(out, true)
+			} else {
+				f.addSplit(out)
+			}
+		case *ArithExp:
+			out, err := shell.arithExp(p)
+			if err != nil {
+				return err
+			}
+			if quoted {
+				f.add(out, true)
+			} else {
+				f.addSplit(out)
+			}
+		}
+	}
+	return nil
+}
+
+// arithExp evaluates an arithmetic expansion.
+func (shell *Shell) arithExp(p *ArithExp) (string, error) {
+	expr, err := shell.expandString(p.Expr)
+	if err != nil {
+		return "", err
+	}
+	n, err := shell.evalArith(expr)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// tildeExpand replaces the tilde-prefix starting a word, an unquoted '~'
+// followed by the characters up to the first '/', with the directory it
+// stands for: `~` the home directory, `~user` the one of user, `~+` the
+// working directory and `~-` the previous one. The directory is taken
+// literally like quoted text.
+func (shell *Shell) tildeExpand(parts []WordPart) []WordPart {
+	if len(parts) == 0 {
+		return parts
+	}
+	lit, ok := parts[0].(*Lit)
+	if !ok {
+		return parts
+	}
+	return append(shell.tildePrefix(lit.Value, len(parts) > 1), parts[1:]...)
+}
+
+// tildePrefix expands the tilde-prefix s starts with, if any. more tells
+// whether s is followed by other parts of the word.
+func (shell *Shell) tildePrefix(s string, more bool) []WordPart {
+	unexpanded := []WordPart{&Lit{Value: s}}
+	if !strings.HasPrefix(s, "~") {
+		return unexpanded
+	}
+
+	prefix, rest, found := strings.Cut(s[1:], "/")
+	if !found && more {
+		// the prefix has to be unquoted as a whole, `~"user"` isn't one
+		return unexpanded
+	}
+	dir, ok := shell.tildeDir(prefix)
+	if !ok {
+		return unexpanded
+	}
+
+	expanded := []WordPart{&SglQuoted{Value: dir}}
+	if found {
+		expanded = append(expanded, &Lit{Value: "/" + rest})
+	}
+	return expanded
+}
+
+func (shell *Shell) tildeDir(prefix string) (string, bool) {
+	switch prefix {
+	case "":
+		if home, ok := shell.lookupParam("HOME"); ok {
+			return home, true
+		}
+		u, err := user.Current()
+		if err != nil {
+			return "", false
+		}
+		return u.HomeDir, true
+	case "+":
+		return shell.lookupParam("PWD")
+	case "-":
+		return shell.lookupParam("OLDPWD")
+	}
+
+	u, err := user.Lookup(prefix)
+	if err != nil {
+		return "", false
+	}
+	return u.HomeDir, true
+}
+
+// commandSubst runs the body of a command substitution in a subshell and
+// returns its output with the trailing newlines removed.
+func (shell *Shell) commandSubst(body *List) (string, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&out, pr)
+		_ = pr.Close()
+		close(done)
+	}()
+
+	sub := shell.subshell()
+	sub.stdout = pw
+	// `exit` only leaves the subshell
+	_ = sub.execute(body)
+
+	_ = pw.Close()
+	<-done
+	shell.status = sub.status
+	shell.substs++
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// expandParam expands a parameter expansion into f, applying its operator.
+func (shell *Shell) expandParam(f *fields, p *ParamExp, quoted bool) error {
+	addValue := func(s string) {
+		if quoted {
+			f.add(s, true)
+		} else {
+			f.addSplit(s)
+		}
+	}
+
+	// each value is a field of its own, like the positional parameters in
+	// "$@"
+	addFields := func(values []string) {
+		for i, v := range values {
+			if i > 0 {
+				f.split()
+			}
+			f.add(v, true)
+		}
+	}
+
+	if p.Name == "@" && quoted && p.Op == "" && !p.Length {
+		addFields(shell.args)
+		return nil
+	}
+
+	value, set := shell.lookupParam(p.Name)
+	if p.Index != nil {
+		elements := shell.elements(p.Name)
+		switch index, _ := p.Index.lit(); index {
+		case "@", "*":
+			if p.Length {
+				addValue(strconv.Itoa(len(elements)))
+				return nil
+			}
+			if index == "@" && quoted && p.Op == "" {
+				addFields(elements)
+				return nil
+			}
+			value, set = shell.ifsJoin(elements), len(elements) > 0
+		default:
+			var err error
+			if value, set, err = shell.lookupElement(p.Name, p.Index); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Length {
+		addValue(strconv.Itoa(utf8.RuneCountInString(value)))
+		return nil
+	}
+
+	// with a ':' the operators treat a parameter set to "" as unset
+	null := !set || (strings.HasPrefix(p.Op, ":") && value == "")
+
+	switch op := strings.TrimPrefix(p.Op, ":"); op {
+	case "":
+		addValue(value)
+	case "-":
+		if null {
+			return shell.expandParts(f, shell.tildeExpand(p.Word.Parts), quoted, !quoted)
+		}
+		addValue(value)
+	case "+":
+		if !null {
+			return shell.expandParts(f, shell.tildeExpand(p.Word.Parts), quoted, !quoted)
+		}
+	case "=":
+		if null && p.Index != nil {
+			// there are no assignments to array elements
+			return NewParamError(p.String(), "cannot assign in this way")
+		}
+		if null {
+			word, err := shell.expandString(p.Word)
+			if err != nil {
+				return err
+			}
+			if err := shell.setParam(p.Name, word); err != nil {
+				return err
+			}
+			value = word
+		}
+		addValue(value)
+	case "?":
+		if null {
+			msg, err := shell.expandString(p.Word)
+			if err != nil {
+				return err
+			}
+			if msg == "" {
+				msg = "parameter null or not set"
+			}
+			return NewParamError(p.Name, msg)
+		}
+		addValue(value)
+	case "#", "##", "%", "%%":
+		pattern, err := shell.expandPattern(p.Word.Parts, false)
+		if err != nil {
+			return err
+		}
+		addValue(trimPattern(value, pattern, op))
+	}
+	return nil
+}
+
+// expandPattern expands parts into a pattern in which only the pattern
+// characters not quoted in the word are special.
+func (shell *Shell) expandPattern(parts []WordPart, quoted bool) (string, error) {
+	var sb strings.Builder
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *Lit:
+			if quoted {
+				sb.WriteString(escapePattern(p.Value))
+			} else {
+				sb.WriteString(p.Value)
+			}
+		case *SglQuoted:
+			sb.WriteString(escapePattern(p.Value))
+		case *DblQuoted:
+			pattern, err := shell.expandPattern(p.Parts, true)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(pattern)
+		case *ParamExp:
+			f := &fields{}
+			if err := shell.expandParam(f, p, true); err != nil {
+				return "", err
+			}
+			if quoted {
+				sb.WriteString(escapePattern(f.cur.String()))
+			} else {
+				sb.WriteString(f.cur.String())
+			}
+		case *CmdSubst:
+			out, err := shell.commandSubst(p.Body)
+			if err != nil {
+				return "", err
+			}
+			if quoted {
+				sb.WriteString(escapePattern(out))
+			} else {
+				sb.WriteString(out)
+			}
+		case *ArithExp:
+			out, err := shell.arithExp(p)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(out)
+		}
+	}
+	return sb.String(), nil
+}
+
+// trimPattern removes the shortest ("#", "%") or longest ("##", "%%") prefix
+// ('#') or suffix ('%') matching pattern from value.
+func trimPattern(value string, pattern string, op string) string {
+	runes := []rune(value)
+	n := len(runes)
+
+	switch op {
+	case "#":
+		for i := 0; i <= n; i++ {
+			if matchPattern(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	case "##":
+		for i := n; i >= 0; i-- {
+			if matchPattern(pattern, string(runes[:i])) {
+				return string(runes[i:])
+			}
+		}
+	case "%":
+		for i := n; i >= 0; i-- {
+			if matchPattern(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	case "%%":
+		for i := 0; i <= n; i++ {
+			if matchPattern(pattern, string(runes[i:])) {
+				return string(runes[:i])
+			}
+		}
+	}
+	return value
+}
+
+// lookupParam returns the value of a parameter and whether it's set.
+func (shell *Shell) lookupParam(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(shell.status), true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "#":
+		return strconv.Itoa(len(shell.args)), true
+	case "@":
+		return strings.Join(shell.args, " "), len(shell.args) > 0
+	case "*":
+		return shell.ifsJoin(shell.args), len(shell.args) > 0
+	case "0":
+		return os.Args[0], true
+	}
+	if isDigits(name) {
+		n, err := strconv.Atoi(name)
+		if err != nil || n > len(shell.args) {
+			return "", false
+		}
+		return shell.args[n-1], true
+	}
+	return shell.lookupVar(name)
+}
+
+// ifsJoin joins values with the first character of IFS, like "$*".
+func (shell *Shell) ifsJoin(values []string) string {
+	sep := " "
+	if ifs, ok := shell.lookupVar("IFS"); ok {
+		sep = ifs[:min(len(ifs), 1)]
+	}
+	return strings.Join(values, sep)
+}
+
+// lookupElement returns the element of the array name that index evaluates
+// to, counting from the end if it's negative.
+func (shell *Shell) lookupElement(name string, index *Word) (string, bool, error) {
+	expr, err := shell.expandString(index)
+	if err != nil {
+		return "", false, err
+	}
+	n, err := shell.evalArith(expr)
+	if err != nil {
+		return "", false, err
+	}
+
+	elements := shell.elements(name)
+	if n < 0 {
+		n += int64(len(elements))
+		if n < 0 {
+			return "", false, NewParamError(name+"["+expr+"]", "bad array subscript")
+		}
+	}
+	if n >= int64(len(elements)) {
+		return "", false, nil
+	}
+	return elements[n], true, nil
+}
+
+// setParam assigns a value to a variable.
+func (shell *Shell) setParam(name string, value string) error {
+	if !isNameStart(name[0]) {
+		return NewParamError("$"+name, "cannot assign in this way")
+	}
+	return shell.setVar(name, value)
+}
+
+// isAllArgs reports whether parts is just `$@`.
+func isAllArgs(parts []WordPart) bool {
+	if len(parts) != 1 {
+		return false
+	}
+	p, ok := parts[0].(*ParamExp)
+	return ok && p.Name == "@" && p.Op == "" && !p.Length
+}
+
+func (shell *Shell) ifs() string {
+	if ifs, ok := shell.lookupParam("IFS"); ok {
+		return ifs
+	}
+	return defaultIFS
+}
+
+// field is a word after field splitting. pattern is the same text with its
+// quoted pattern characters escaped, for pathname expansion.
+type field struct {
+	value   string
+	pattern string
+}
+
+// fields accumulates the fields a word expands to. Text resulting from
+// unquoted expansions is split at the characters of IFS, any other text is
+// appended to the current field as is.
+type fields struct {
+	ifs     string
+	list    []field
+	cur     strings.Builder
+	pattern strings.Builder
+	inField bool // whether cur is a field even if empty, e.g. for `""`
+}
+
+func (f *fields) add(s string, quoted bool) {
+	f.cur.WriteString(s)
+	if quoted {
+		f.pattern.WriteString(escapePattern(s))
+	} else {
+		f.pattern.WriteString(strings.ReplaceAll(s, "\\", "\\\\"))
+	}
+	f.inField = true
+}
+
+// addSplit adds unquoted s splitting it at IFS characters. A run of IFS
+// whitespace separates fields, any other IFS character delimits a field on
+// its own, possibly an empty one.
+func (f *fields) addSplit(s string) {
+	isWhite := func(ch byte) bool {
+		return (ch == ' ' || ch == '\t' || ch == '\n') && strings.IndexByte(f.ifs, ch) >= 0
+	}
+
+	for i := 0; i < len(s); {
+		j := strings.IndexAny(s[i:], f.ifs)
+		if j < 0 {
+			f.add(s[i:], false)
+			return
+		}
+		if j > 0 {
+			f.add(s[i:i+j], false)
+			i += j
+		}
+
+		delimited := false
+		for i < len(s) && isWhite(s[i]) {
+			i++
+		}
+		if i < len(s) && strings.IndexByte(f.ifs, s[i]) >= 0 {
+			delimited = true
+			i++
+			for i < len(s) && isWhite(s[i]) {
+				i++
+			}
+		}
+		if f.inField || delimited {
+			f.split()
+		}
+	}
+}
+
+// split ends the current field.
+func (f *fields) split() {
+	f.list = append(f.list, field{value: f.cur.String(), pattern: f.pattern.String()})
+	f.cur.Reset()
+	f.pattern.Reset()
+	f.inField = false
+}
+
+func (f *fields) result() []field {
+	if f.inField {
+		f.split()
+	}
+	return f.list
+}
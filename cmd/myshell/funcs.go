@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxFuncDepth limits the nesting of function calls, so that a function
+// calling itself endlessly fails instead of the shell running out of stack.
+const maxFuncDepth = 1000
+
+// callFunc runs the body of a function with the arguments as its positional
+// parameters and the variables it declares local restored afterwards.
+func (shell *Shell) callFunc(fn *FuncDecl, argv []string) (int, error) {
+	if len(shell.locals) >= maxFuncDepth {
+		fmt.Fprintf(shell.stderr, "%s: maximum function nesting level exceeded (%d)\n", fn.Name, maxFuncDepth)
+		return 1, nil
+	}
+
+	args := shell.args
+	shell.args = argv[1:]
+	shell.locals = append(shell.locals, map[string]variable{})
+	defer func() {
+		frame := shell.locals[len(shell.locals)-1]
+		for name, v := range frame {
+			if v.set || v.exported || v.readonly {
+				shell.vars[name] = v
+			} else {
+				delete(shell.vars, name)
+			}
+		}
+		shell.locals = shell.locals[:len(shell.locals)-1]
+		shell.args = args
+		shell.returning = false
+	}()
+
+	return shell.runCompound(fn.Body)
+}
+
+// local declares variables local to the function being run: their values
+// are restored once it returns, and until then the functions it calls see
+// the local ones.
+func (shell *Shell) local(argv []string) int {
+	if len(shell.locals) == 0 {
+		fmt.Fprintln(shell.stderr, "local: can only be used in a function")
+		return 1
+	}
+	frame := shell.locals[len(shell.locals)-1]
+
+	status := 0
+	for _, arg := range argv[1:] {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isName(name) {
+			fmt.Fprintf(shell.stderr, "local: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+		v := shell.vars[name]
+		if v.readonly {
+			fmt.Fprintf(shell.stderr, "local: %s\n", NewParamError(name, "readonly variable").Error())
+			status = 1
+			continue
+		}
+
+		if _, ok := frame[name]; !ok {
+			frame[name] = v
+			delete(shell.vars, name)
+		}
+		if hasValue {
+			_ = shell.setVar(name, value)
+		}
+	}
+	return status
+}
+
+// returnFunc implements `return [n]`, which takes effect once the lists it's
+// part of have unwound up to the function.
+func (shell *Shell) returnFunc(argv []string) int {
+	if len(shell.locals) == 0 {
+		fmt.Fprintln(shell.stderr, "return: can only `return' from a function")
+		return 1
+	}
+	if len(argv) > 2 {
+		fmt.Fprintln(shell.stderr, "return: too many arguments")
+		return 1
+	}
+
+	status := shell.status
+	if len(argv) == 2 {
+		n, err := strconv.Atoi(argv[1])
+		if err != nil {
+			fmt.Fprintf(shell.stderr, "return: %s: numeric argument required\n", argv[1])
+			n = 2
+		}
+		status = n & 0xff
+	}
+	shell.returning = true
+	return status
+}
@@ -19,6 +19,7 @@ const (
 	CR       = 13
 	NL       = 10
 	SIGINT   = 3
+	SIGTSTP  = 26
 	TAB      = 9
 	BELL     = 7
 	LBRACKET = 91
@@ -409,6 +410,9 @@ func readInput(
 				fmt.Printf("^C")
 				errorCh <- SignalInterruptErr
 				return
+			case SIGTSTP:
+				// there's no job to stop at the prompt
+				continue
 			case CR, NL:
 				return
 			case TAB:
@@ -428,11 +432,13 @@ func readInput(
 }
 
 func parseInput(
-	tokenCh chan []Token,
+	listCh chan *List,
 	errorCh chan error,
 	historyF *os.File,
 ) {
-	parser := newParser()
+	var input strings.Builder
+	var list *List
+
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
 		panic(err)
@@ -445,12 +451,12 @@ func parseInput(
 		if err != nil {
 			panic(err)
 		}
-		if len(parser.tokens) > 0 {
-			tokenCh <- parser.tokens
+		if list != nil && len(list.Items) > 0 {
+			listCh <- list
 		}
 		// TODO: how to synchronize terminal mode
 		// restoration with the main goroutine?
-		close(tokenCh)
+		close(listCh)
 		close(errorCh)
 	}()
 
@@ -463,14 +469,21 @@ Loop:
 	case err := <-readInputErrorCh:
 		errorCh <- err
 		return
-	case input, ok := <-inputCh:
-		if !ok || len(input) == 0 {
-			return
+	case line, ok := <-inputCh:
+		if !ok || len(line) == 0 {
+			if input.Len() == 0 {
+				return
+			}
+			// an empty line completing previous input, e.g. in a here-document
+			line = "\n"
 		}
 
-		err := parser.parse(input)
+		// the whole input is parsed again with every line
+		// as a construct can span multiple lines
+		input.WriteString(line)
+		parsed, err := parse(input.String())
 		if err != nil {
-			if errors.Is(err, UnclosedQuoteErr) || errors.Is(err, PipeHasNoTargetErr) {
+			if incomplete(err) {
 				prompt = awaitPrompt
 				drawPrompt(awaitPrompt)
 				goto Loop
@@ -480,21 +493,7 @@ Loop:
 			}
 		}
 
+		list = parsed
 		return
 	}
 }
-
-func splitAtPipe(tokens []Token) [][]Token {
-	cmds := make([][]Token, 1)
-	idx := 0
-
-	for _, tok := range tokens {
-		if t, ok := tok.(*LiteralToken); ok && t.literal == "|" {
-			cmds = append(cmds, []Token{})
-			idx++
-			continue
-		}
-		cmds[idx] = append(cmds[idx], tok)
-	}
-	return cmds
-}
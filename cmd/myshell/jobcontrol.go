@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// initJobControl turns on job control if the shell reads from the terminal
+// tty: the shell becomes the leader of a process group of its own, which
+// hands the terminal over to the pipelines it runs and takes it back once
+// they're done or stopped.
+func (shell *Shell) initJobControl(tty int) {
+	if !term.IsTerminal(tty) {
+		return
+	}
+	// started in the background, e.g. with `&`, wait to be brought to the
+	// foreground
+	for {
+		pgrp, err := unix.IoctlGetInt(tty, unix.TIOCGPGRP)
+		if err != nil {
+			return
+		}
+		if pgrp == syscall.Getpgrp() {
+			break
+		}
+		_ = syscall.Kill(0, syscall.SIGTTIN)
+	}
+
+	// Ctrl+Z stops the jobs but not the shell. The signals are caught
+	// rather than ignored, so that the commands get the default actions.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU)
+
+	pid := os.Getpid()
+	if syscall.Getpgrp() != pid {
+		if err := syscall.Setpgid(0, 0); err != nil {
+			return
+		}
+	}
+	if err := tcsetpgrp(tty, pid); err != nil {
+		return
+	}
+
+	shell.tty = tty
+	shell.pgid = pid
+	shell.ttyState, _ = term.GetState(tty)
+	shell.jobControl = true
+}
+
+// reclaimTerminal makes the shell the foreground process group again once
+// group is done or stopped. The terminal modes are restored if a command
+// may have left them changed, or else saved as the ones of the shell, e.g.
+// after `stty`.
+func (shell *Shell) reclaimTerminal(group *procGroup, restore bool) {
+	if !shell.jobControl || group.processGroup() == 0 {
+		return
+	}
+	_ = tcsetpgrp(shell.tty, shell.pgid)
+	if restore && shell.ttyState != nil {
+		_ = term.Restore(shell.tty, shell.ttyState)
+	} else if state, err := term.GetState(shell.tty); err == nil {
+		shell.ttyState = state
+	}
+}
+
+// procGroup is the process group of a pipeline run in the foreground or a
+// job run in the background, including the processes started by the
+// compound commands it runs in the shell process. The first process started
+// is the leader of the group, which lasts as long as any of its processes
+// hasn't been reaped; a process started later on starts a new one.
+type procGroup struct {
+	own        bool // the processes are put in a process group of their own
+	foreground bool // the leader takes the terminal tty
+	tty        int
+
+	// sigint is sent SIGINT when a process is killed by it, which the
+	// commands run in the shell process take as Ctrl+C
+	sigint chan os.Signal
+	// stops is notified when all processes have been stopped
+	stops chan struct{}
+
+	mu      sync.Mutex
+	resumed *sync.Cond
+	pgid    int
+	live    int  // processes not reaped
+	stopped int  // processes stopped
+	paused  bool // stopped as a whole, no other processes start until it's resumed
+	stopSig syscall.Signal
+}
+
+// proc is a process started by a group.
+type proc struct {
+	cmd     *exec.Cmd
+	stopped bool
+
+	// set once done is closed: the exit status, the user and system CPU
+	// time used and the error of cmd.Wait, which copies the output left
+	// after the process was reaped
+	status int
+	user   time.Duration
+	sys    time.Duration
+	err    error
+	done   chan struct{}
+}
+
+func (shell *Shell) newProcGroup(own bool, foreground bool) *procGroup {
+	g := &procGroup{
+		own:        own,
+		foreground: foreground,
+		tty:        shell.tty,
+		sigint:     make(chan os.Signal, 1),
+		stops:      make(chan struct{}, 1),
+	}
+	g.resumed = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *procGroup) processGroup() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pgid
+}
+
+func (g *procGroup) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+func (g *procGroup) stopSignal() syscall.Signal {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stopSig
+}
+
+// start starts cmd in the group once the group isn't stopped.
+func (g *procGroup) start(cmd *exec.Cmd) (*proc, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.resumed.Wait()
+	}
+
+	leader := g.own && g.live == 0
+	if g.own {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: g.pgid}
+		if leader {
+			cmd.SysProcAttr.Pgid = 0
+			if g.foreground {
+				// by the child itself, before it might read from the terminal
+				cmd.SysProcAttr.Foreground = true
+				cmd.SysProcAttr.Ctty = g.tty
+			}
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &proc{cmd: cmd, done: make(chan struct{})}
+	if leader {
+		g.pgid = cmd.Process.Pid
+	}
+	g.live++
+	go g.watch(p)
+	return p, nil
+}
+
+// reaped forgets about p once it's reaped, which is done with the group
+// locked so that no process tries to join it once it's gone.
+func (g *procGroup) reaped(p *proc) {
+	g.live--
+	if p.stopped {
+		g.stopped--
+	}
+	g.update()
+}
+
+// finish records the exit status of p, which was killed by a signal if
+// killed, and lets the ones waiting for it know once the output it left is
+// copied.
+func (g *procGroup) finish(p *proc, status int, killed bool) {
+	p.status = status
+	if killed {
+		p.status = 128 + status
+		if syscall.Signal(status) == syscall.SIGINT {
+			select {
+			case g.sigint <- syscall.SIGINT:
+			default:
+			}
+		}
+	}
+
+	// the process is reaped already
+	if err := p.cmd.Wait(); !errors.Is(err, syscall.ECHILD) {
+		p.err = err
+	}
+	close(p.done)
+}
+
+func (g *procGroup) setStopped(p *proc, stopped bool, sig syscall.Signal) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p.stopped == stopped {
+		return
+	}
+	p.stopped = stopped
+	if stopped {
+		g.stopped++
+		g.stopSig = sig
+	} else {
+		g.stopped--
+		g.paused = false
+		g.resumed.Broadcast()
+	}
+	g.update()
+}
+
+// update pauses the group once all of its processes are stopped.
+func (g *procGroup) update() {
+	if g.paused || g.live == 0 || g.stopped < g.live {
+		return
+	}
+	g.paused = true
+	select {
+	case g.stops <- struct{}{}:
+	default:
+	}
+}
+
+// resume continues the processes of a stopped group and lets the others
+// start.
+func (g *procGroup) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.own && g.live > 0 {
+		_ = syscall.Kill(-g.pgid, syscall.SIGCONT)
+	}
+	g.paused = false
+	g.resumed.Broadcast()
+}
+
+// setForeground hands the terminal over to the group, right away if it has
+// processes or else to the first one it starts.
+func (g *procGroup) setForeground(foreground bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.foreground = foreground
+	if foreground && g.own && g.live > 0 {
+		_ = tcsetpgrp(g.tty, g.pgid)
+	}
+}
+
+// signal sends sig to the processes of the group.
+func (g *procGroup) signal(sig syscall.Signal) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.own && g.live > 0 {
+		_ = syscall.Kill(-g.pgid, sig)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// the si_code of SIGCHLD, telling what happened to the child
+const (
+	cldExited    = 1
+	cldKilled    = 2
+	cldDumped    = 3
+	cldStopped   = 5
+	cldContinued = 6
+)
+
+// siginfo is the siginfo_t waitid fills in, with the fields of SIGCHLD that
+// unix.Siginfo leaves out. They're part of a union aligned like a pointer.
+type siginfo struct {
+	Signo int32
+	Errno int32
+	Code  int32
+	Child struct {
+		_      [0]uintptr
+		Pid    int32
+		Uid    uint32
+		Status int32 // the exit status or the signal
+	}
+	_ [116]byte
+}
+
+// siginfo has to hold as much as unix.Siginfo
+var _ [unsafe.Sizeof(siginfo{}) - unsafe.Sizeof(unix.Siginfo{})]byte
+
+// waitid waits for the process pid to change state like waitid(2).
+func waitid(pid int, info *siginfo, options int, rusage *unix.Rusage) error {
+	for {
+		err := unix.Waitid(unix.P_PID, pid, (*unix.Siginfo)(unsafe.Pointer(info)), options, rusage)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// tcsetpgrp makes pgid the foreground process group of the terminal tty.
+// SIGTTOU, which the shell gets doing so from the background, is blocked
+// meanwhile.
+func tcsetpgrp(tty int, pgid int) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var set, old unix.Sigset_t
+	set.Val[0] = 1 << (uint(syscall.SIGTTOU) - 1)
+	if err := unix.PthreadSigmask(unix.SIG_BLOCK, &set, &old); err != nil {
+		return err
+	}
+	defer func() { _ = unix.PthreadSigmask(unix.SIG_SETMASK, &old, nil) }()
+	return unix.IoctlSetPointerInt(tty, unix.TIOCSPGRP, pgid)
+}
+
+// watch follows p being stopped and continued until it exits and reaps it.
+// The state changes are only looked at until the process is reaped, with
+// the group locked.
+func (g *procGroup) watch(p *proc) {
+	pid := p.cmd.Process.Pid
+	var info siginfo
+	for {
+		if err := waitid(pid, &info, unix.WEXITED|unix.WSTOPPED|unix.WCONTINUED|unix.WNOWAIT, nil); err != nil {
+			break
+		}
+
+		switch info.Code {
+		case cldStopped:
+			_ = waitid(pid, &info, unix.WSTOPPED|unix.WNOHANG, nil)
+			g.setStopped(p, true, syscall.Signal(info.Child.Status))
+			continue
+		case cldContinued:
+			_ = waitid(pid, &info, unix.WCONTINUED|unix.WNOHANG, nil)
+			g.setStopped(p, false, 0)
+			continue
+		}
+		break
+	}
+
+	var rusage unix.Rusage
+	g.mu.Lock()
+	_ = waitid(pid, &info, unix.WEXITED, &rusage)
+	g.reaped(p)
+	g.mu.Unlock()
+	p.user, p.sys = time.Duration(rusage.Utime.Nano()), time.Duration(rusage.Stime.Nano())
+
+	killed := info.Code == cldKilled || info.Code == cldDumped
+	g.finish(p, int(info.Child.Status), killed)
+}
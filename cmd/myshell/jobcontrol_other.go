@@ -0,0 +1,69 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ttouMu keeps tcsetpgrp from turning SIGTTOU back on while another call is
+// still under way.
+var ttouMu sync.Mutex
+
+// tcsetpgrp makes pgid the foreground process group of the terminal tty.
+// SIGTTOU, which the shell gets doing so from the background, is ignored
+// meanwhile and caught again afterwards, see initJobControl.
+func tcsetpgrp(tty int, pgid int) error {
+	ttouMu.Lock()
+	defer ttouMu.Unlock()
+
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Notify(make(chan os.Signal, 1), syscall.SIGTTOU)
+	return unix.IoctlSetPointerInt(tty, unix.TIOCSPGRP, pgid)
+}
+
+// watch follows p being stopped and continued until it exits and reaps it.
+//
+// Without waitid the process is reaped as soon as it exits, before the group
+// is locked, so a process starting meanwhile may fail to join the group.
+func (g *procGroup) watch(p *proc) {
+	pid := p.cmd.Process.Pid
+	var ws syscall.WaitStatus
+	var rusage syscall.Rusage
+	for {
+		_, err := syscall.Wait4(pid, &ws, syscall.WUNTRACED|syscall.WCONTINUED, &rusage)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			break
+		}
+
+		switch {
+		case ws.Stopped():
+			g.setStopped(p, true, ws.StopSignal())
+			continue
+		case ws.Continued():
+			g.setStopped(p, false, 0)
+			continue
+		}
+		break
+	}
+
+	g.mu.Lock()
+	g.reaped(p)
+	g.mu.Unlock()
+	p.user, p.sys = time.Duration(rusage.Utime.Nano()), time.Duration(rusage.Stime.Nano())
+
+	if ws.Signaled() {
+		g.finish(p, int(ws.Signal()), true)
+	} else {
+		g.finish(p, ws.ExitStatus(), false)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// job is an and-or list run in the background with `&`, or a pipeline
+// stopped in the foreground with Ctrl+Z. Its processes are in a process
+// group of their own, so that Ctrl+C at the prompt doesn't reach them, and
+// the commands it runs in the shell process are run by a subshell in a
+// goroutine.
+type job struct {
+	id     int
+	source string
+	group  *procGroup
+
+	started   chan struct{} // closed once the first pipeline is running
+	startOnce sync.Once
+	done      chan struct{} // closed once the job is done, status is set then
+	status    int
+
+	tty      *term.State // the terminal modes the job was stopped with
+	reported string      // the state the job was last reported in
+}
+
+// jobTable holds the jobs of the shell, the current one last. Subshells run
+// in the foreground share it, so that a pipeline they run can be stopped
+// and resumed.
+type jobTable struct {
+	list []*job
+}
+
+func (t *jobTable) clone() *jobTable {
+	return &jobTable{list: slices.Clone(t.list)}
+}
+
+func newJob(source string, group *procGroup) *job {
+	return &job{
+		source:  source,
+		group:   group,
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// add adds j as the current job, numbered one more than the last one.
+func (t *jobTable) add(j *job) {
+	j.id = 1
+	if len(t.list) > 0 {
+		j.id = t.list[len(t.list)-1].id + 1
+	}
+	t.list = append(t.list, j)
+}
+
+func (t *jobTable) remove(j *job) {
+	t.list = slices.DeleteFunc(t.list, func(other *job) bool {
+		return other == j
+	})
+}
+
+// setCurrent makes j the current job, adding it if it isn't in the table
+// yet.
+func (t *jobTable) setCurrent(j *job) {
+	if !slices.Contains(t.list, j) {
+		t.add(j)
+		return
+	}
+	t.remove(j)
+	t.list = append(t.list, j)
+}
+
+// jobStarted records that the job the shell is running for, if any, has
+// started its first pipeline.
+func (shell *Shell) jobStarted() {
+	if j := shell.job; j != nil {
+		j.startOnce.Do(func() { close(j.started) })
+	}
+}
+
+func (j *job) finish(status int) {
+	j.status = status
+	j.startOnce.Do(func() { close(j.started) })
+	close(j.done)
+}
+
+func (j *job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal sends sig to the processes of the job as well as to the commands
+// it runs in the shell process.
+func (j *job) signal(sig syscall.Signal) {
+	j.group.signal(sig)
+	if sig == syscall.SIGINT {
+		select {
+		case j.group.sigint <- sig:
+		default:
+		}
+	}
+}
+
+// state describes the job the way `jobs` lists it.
+func (j *job) state() string {
+	switch {
+	case !j.finished() && j.group.isPaused():
+		return stopNames[j.group.stopSignal()]
+	case !j.finished():
+		return "Running"
+	case j.status == 0:
+		return "Done"
+	case j.status > 128:
+		if name, ok := signalNames[syscall.Signal(j.status-128)]; ok {
+			return name
+		}
+		fallthrough
+	default:
+		return fmt.Sprintf("Exit %d", j.status)
+	}
+}
+
+// signalNames describe the signals killing a job most commonly.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "Hangup",
+	syscall.SIGINT:  "Interrupt",
+	syscall.SIGQUIT: "Quit",
+	syscall.SIGKILL: "Killed",
+	syscall.SIGPIPE: "Broken pipe",
+	syscall.SIGTERM: "Terminated",
+}
+
+// stopNames describe the signals stopping a job.
+var stopNames = map[syscall.Signal]string{
+	syscall.SIGTSTP: "Stopped",
+	syscall.SIGSTOP: "Stopped (signal)",
+	syscall.SIGTTIN: "Stopped (tty input)",
+	syscall.SIGTTOU: "Stopped (tty output)",
+}
+
+// runBackground starts andOr as a new job and reports its number and
+// process group once its first pipeline is running. The job runs in a
+// subshell, so neither assignments nor a `cd` affect the shell.
+func (shell *Shell) runBackground(andOr *AndOr) {
+	group := shell.newProcGroup(true, false)
+	j := newJob(andOr.Source, group)
+	shell.jobs.add(j)
+
+	sub := shell.subshell()
+	sub.job = j
+	sub.group = group
+	sub.sigint = group.sigint
+	sub.jobs = shell.jobs.clone()
+	sub.timer = nil
+	var devNull *os.File
+	if !shell.jobControl {
+		// without job control a background job can't read from the
+		// terminal, with it the job is stopped if it tries to
+		if f, err := os.Open(os.DevNull); err == nil {
+			devNull = f
+			sub.stdin = f
+		}
+	}
+
+	go func() {
+		// `exit` only leaves the job
+		_ = sub.runAndOr(andOr)
+		if devNull != nil {
+			_ = devNull.Close()
+		}
+		j.finish(sub.status)
+	}()
+
+	<-j.started
+	if pgid := group.processGroup(); pgid != 0 {
+		fmt.Fprintf(os.Stderr, "[%d] %d\n", j.id, pgid)
+	} else {
+		fmt.Fprintf(os.Stderr, "[%d]\n", j.id)
+	}
+}
+
+// waitForeground waits for a job run in the foreground, passing Ctrl+C on
+// to it, and returns its status once it's done or stopped.
+func (shell *Shell) waitForeground(j *job) int {
+	for {
+		select {
+		case <-j.done:
+			j.group.setForeground(false)
+			shell.reclaimTerminal(j.group, j.status > 128)
+			shell.jobs.remove(j)
+			return j.status
+		case <-j.group.stops:
+			if !j.group.isPaused() {
+				// resumed in the meantime
+				continue
+			}
+			shell.suspend(j)
+			return 128 + int(j.group.stopSignal())
+		case sig := <-shell.sigint:
+			j.signal(sig.(syscall.Signal))
+		}
+	}
+}
+
+// suspend takes the terminal back from a job stopped in the foreground,
+// which becomes the current job.
+func (shell *Shell) suspend(j *job) {
+	j.group.setForeground(false)
+	if shell.jobControl {
+		j.tty, _ = term.GetState(shell.tty)
+	}
+	shell.reclaimTerminal(j.group, true)
+	shell.jobs.setCurrent(j)
+	fmt.Fprintln(os.Stderr)
+	shell.printJob(os.Stderr, j, false)
+}
+
+// notifyJobs reports the jobs done or stopped since the last prompt and
+// removes the ones done from the job table.
+func (shell *Shell) notifyJobs(w io.Writer) {
+	for _, j := range slices.Clone(shell.jobs.list) {
+		if j.finished() {
+			shell.printJob(w, j, false)
+			shell.jobs.remove(j)
+		} else if state := j.state(); state != j.reported && state != "Running" {
+			shell.printJob(w, j, false)
+		}
+	}
+}
+
+// printJob prints a line of the output of `jobs` for j, prefixed with its
+// process group if long is set.
+func (shell *Shell) printJob(w io.Writer, j *job, long bool) {
+	mark := shell.jobMark(j)
+	state := j.state()
+	j.reported = state
+	source := j.source
+	if state == "Running" {
+		source += " &"
+	}
+	if long {
+		fmt.Fprintf(w, "[%d]%s %d %-24s%s\n", j.id, mark, j.group.processGroup(), state, source)
+		return
+	}
+	fmt.Fprintf(w, "[%d]%s  %-24s%s\n", j.id, mark, state, source)
+}
+
+// jobMark returns "+" for the current job, "-" for the previous one and a
+// blank for the others.
+func (shell *Shell) jobMark(j *job) string {
+	switch jobs := shell.jobs.list; {
+	case len(jobs) > 0 && jobs[len(jobs)-1] == j:
+		return "+"
+	case len(jobs) > 1 && jobs[len(jobs)-2] == j:
+		return "-"
+	}
+	return " "
+}
+
+// findJob resolves a job spec: `%n` is job number n, `%+`, `%%` or `%` the
+// current job, `%-` the previous one, `%str` the job whose command starts
+// with str and `%?str` the one whose command contains str.
+func (shell *Shell) findJob(spec string) (*job, error) {
+	jobs := shell.jobs.list
+	n := len(jobs)
+	rest, ok := strings.CutPrefix(spec, "%")
+	if !ok {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+
+	switch {
+	case rest == "" || rest == "+" || rest == "%":
+		if n == 0 {
+			return nil, fmt.Errorf("current: no such job")
+		}
+		return jobs[n-1], nil
+	case rest == "-":
+		if n < 2 {
+			return nil, fmt.Errorf("previous: no such job")
+		}
+		return jobs[n-2], nil
+	case isDigits(rest):
+		id, _ := strconv.Atoi(rest)
+		for _, j := range jobs {
+			if j.id == id {
+				return j, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+
+	match := func(j *job) bool { return strings.HasPrefix(j.source, rest) }
+	if substr, ok := strings.CutPrefix(rest, "?"); ok {
+		match = func(j *job) bool { return strings.Contains(j.source, substr) }
+	}
+	var found *job
+	for _, j := range jobs {
+		if !match(j) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+		}
+		found = j
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return found, nil
+}
+
+// jobs lists the jobs: with -l along with their process groups, with -p
+// only the process groups.
+func (shell *Shell) listJobs(argv []string) int {
+	out := shell.builtinStdout(JOBS)
+
+	long, pgids := false, false
+	args := argv[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'l':
+				long = true
+			case 'p':
+				pgids = true
+			default:
+				fmt.Fprintf(shell.stderr, "jobs: -%c: invalid option\n", flag)
+				fmt.Fprintln(shell.stderr, "jobs: usage: jobs [-lp] [jobspec ...]")
+				return 2
+			}
+		}
+		args = args[1:]
+	}
+
+	listed := slices.Clone(shell.jobs.list)
+	status := 0
+	if len(args) > 0 {
+		listed = nil
+		for _, spec := range args {
+			j, err := shell.findJob(spec)
+			if err != nil {
+				fmt.Fprintf(shell.stderr, "jobs: %s\n", err.Error())
+				status = 1
+				continue
+			}
+			listed = append(listed, j)
+		}
+	}
+
+	for _, j := range listed {
+		if pgids {
+			fmt.Fprintf(out, "%d\n", j.group.processGroup())
+			continue
+		}
+		shell.printJob(out, j, long)
+	}
+	// the ones done have been reported now
+	for _, j := range listed {
+		if j.finished() {
+			shell.jobs.remove(j)
+		}
+	}
+	return status
+}
+
+// fg resumes a job in the foreground, handing the terminal over to it, and
+// returns its status once it's done or stopped again.
+func (shell *Shell) fg(argv []string) int {
+	spec := "%+"
+	if len(argv) > 1 {
+		spec = argv[1]
+	}
+	j, err := shell.findJob(spec)
+	if err != nil {
+		fmt.Fprintf(shell.stderr, "fg: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Fprintln(shell.stderr, j.source)
+	if shell.jobControl {
+		if j.tty != nil {
+			_ = term.Restore(shell.tty, j.tty)
+		}
+		j.group.setForeground(true)
+	}
+	j.group.resume()
+	return shell.waitForeground(j)
+}
+
+// bg resumes stopped jobs in the background.
+func (shell *Shell) bg(argv []string) int {
+	specs := argv[1:]
+	if len(specs) == 0 {
+		specs = []string{"%+"}
+	}
+
+	status := 0
+	for _, spec := range specs {
+		j, err := shell.findJob(spec)
+		if err != nil {
+			fmt.Fprintf(shell.stderr, "bg: %s\n", err.Error())
+			status = 1
+			continue
+		}
+		if j.finished() {
+			fmt.Fprintf(shell.stderr, "bg: job %d has terminated\n", j.id)
+			status = 1
+			continue
+		}
+		if !j.group.isPaused() {
+			fmt.Fprintf(shell.stderr, "bg: job %d already in background\n", j.id)
+			continue
+		}
+		j.group.resume()
+		j.reported = "Running"
+		fmt.Fprintf(shell.stderr, "[%d]%s %s &\n", j.id, shell.jobMark(j), j.source)
+	}
+	return status
+}
+
+// wait waits for the given jobs, or process groups of jobs, and returns the
+// status of the last one, or for all jobs without arguments. Ctrl+C stops
+// the waiting but not the jobs.
+func (shell *Shell) wait(argv []string) int {
+	var jobs []*job // nil for the ones not found
+	if len(argv) < 2 {
+		jobs = slices.Clone(shell.jobs.list)
+	}
+	for _, spec := range argv[1:] {
+		var j *job
+		var err error
+		if pid, convErr := strconv.Atoi(spec); convErr == nil {
+			j, err = shell.jobOfProcess(pid)
+		} else {
+			j, err = shell.findJob(spec)
+		}
+		if err != nil {
+			fmt.Fprintf(shell.stderr, "wait: %s\n", err.Error())
+			jobs = append(jobs, nil)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	status := 0
+	for _, j := range jobs {
+		if j == nil {
+			status = 127
+			continue
+		}
+		select {
+		case <-j.done:
+		case sig := <-shell.sigint:
+			return 128 + int(sig.(syscall.Signal))
+		}
+		shell.jobs.remove(j)
+		status = j.status
+	}
+	if len(argv) < 2 {
+		return 0
+	}
+	return status
+}
+
+func (shell *Shell) jobOfProcess(pid int) (*job, error) {
+	for _, j := range shell.jobs.list {
+		if j.group.processGroup() == pid {
+			return j, nil
+		}
+	}
+	return nil, fmt.Errorf("pid %d is not a child of this shell", pid)
+}
+
+// disown removes jobs from the job table, all of them with -a, without
+// stopping them.
+func (shell *Shell) disown(argv []string) int {
+	specs := argv[1:]
+	if len(specs) == 1 && specs[0] == "-a" {
+		shell.jobs.list = nil
+		return 0
+	}
+	if len(specs) == 0 {
+		specs = []string{"%+"}
+	}
+
+	status := 0
+	for _, spec := range specs {
+		j, err := shell.findJob(spec)
+		if err != nil {
+			fmt.Fprintf(shell.stderr, "disown: %s\n", err.Error())
+			status = 1
+			continue
+		}
+		shell.jobs.remove(j)
+	}
+	return status
+}
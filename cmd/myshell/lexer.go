@@ -0,0 +1,745 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pos is a position in the input, both 1-based.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+type TokenKind int
+
+const (
+	EOFToken TokenKind = iota
+	WordToken
+	IONumberToken // the fd of a redirection, digits directly followed by '<' or '>'
+	NewlineToken
+	OperatorToken // control and redirection operators
+)
+
+type Token struct {
+	kind   TokenKind
+	pos    Pos
+	offset int    // of the first byte in the input
+	op     string // OperatorToken
+	word   *Word  // WordToken
+	fd     int    // IONumberToken
+}
+
+func (t Token) String() string {
+	switch t.kind {
+	case EOFToken:
+		return "EOF"
+	case WordToken:
+		s, _ := t.word.unquoted()
+		return s
+	case IONumberToken:
+		return fmt.Sprint(t.fd)
+	case NewlineToken:
+		return "newline"
+	default:
+		return t.op
+	}
+}
+
+// operators sorted so that the longest operator sharing a prefix comes first
+var operators = []string{
+	";;&", "<<<", "<<-", "&>>",
+	"&&", "||", ";;", ";&", "<<", ">>", ">|", "<&", ">&", "&>", "<>",
+	"|", "&", ";", "(", ")", "<", ">",
+}
+
+func isRedirectOp(op string) bool {
+	switch op {
+	case "<", ">", ">>", ">|", "<<", "<<-", "<<<", "<&", ">&", "&>", "&>>", "<>":
+		return true
+	}
+	return false
+}
+
+// isMeta reports whether ch terminates an unquoted word.
+func isMeta(ch byte) bool {
+	switch ch {
+	case ' ', '\t', '\n', '|', '&', ';', '<', '>', '(', ')':
+		return true
+	}
+	return false
+}
+
+// Lexer splits the input into tokens. Here-document bodies are read when the
+// newline ending the line with their redirections is reached.
+type Lexer struct {
+	input    string
+	offset   int
+	line     int
+	col      int
+	heredocs []*Redirect // here-documents whose body starts after the next newline
+}
+
+func newLexer(input string) *Lexer {
+	return &Lexer{
+		input:    input,
+		offset:   0,
+		line:     1,
+		col:      1,
+		heredocs: nil,
+	}
+}
+
+func (l *Lexer) pos() Pos {
+	return Pos{Line: l.line, Col: l.col}
+}
+
+func (l *Lexer) eof() bool {
+	return l.offset >= len(l.input)
+}
+
+func (l *Lexer) peekByte(n int) byte {
+	if l.offset+n >= len(l.input) {
+		return 0
+	}
+	return l.input[l.offset+n]
+}
+
+func (l *Lexer) advance(n int) {
+	for ; n > 0 && l.offset < len(l.input); n-- {
+		if l.input[l.offset] == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+		l.offset++
+	}
+}
+
+// skipBlanks skips blanks, line continuations and comments.
+func (l *Lexer) skipBlanks() {
+	for !l.eof() {
+		switch ch := l.peekByte(0); {
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			l.advance(1)
+		case ch == '\\' && l.peekByte(1) == '\n':
+			l.advance(2)
+		case ch == '#':
+			for !l.eof() && l.peekByte(0) != '\n' {
+				l.advance(1)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lexer) next() (Token, error) {
+	l.skipBlanks()
+	pos, offset := l.pos(), l.offset
+
+	if l.eof() {
+		if len(l.heredocs) > 0 {
+			return Token{}, HeredocPendingErr
+		}
+		return Token{kind: EOFToken, pos: pos, offset: offset}, nil
+	}
+
+	if l.peekByte(0) == '\n' {
+		l.advance(1)
+		if err := l.readHeredocs(); err != nil {
+			return Token{}, err
+		}
+		return Token{kind: NewlineToken, pos: pos, offset: offset}, nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(l.input[l.offset:], op) {
+			l.advance(len(op))
+			return Token{kind: OperatorToken, pos: pos, offset: offset, op: op}, nil
+		}
+	}
+
+	word, err := l.lexWord()
+	if err != nil {
+		return Token{}, err
+	}
+	if s, ok := word.lit(); ok && isDigits(s) && (l.peekByte(0) == '<' || l.peekByte(0) == '>') {
+		var fd int
+		if _, err := fmt.Sscan(s, &fd); err == nil {
+			return Token{kind: IONumberToken, pos: pos, offset: offset, fd: fd}, nil
+		}
+	}
+	return Token{kind: WordToken, pos: pos, offset: offset, word: word}, nil
+}
+
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Lexer) lexWord() (*Word, error) {
+	word := &Word{Position: l.pos()}
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			word.Parts = append(word.Parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for !l.eof() {
+		ch := l.peekByte(0)
+		if isMeta(ch) {
+			break
+		}
+
+		switch ch {
+		case '\'':
+			flush()
+			l.advance(1)
+			end := strings.IndexByte(l.input[l.offset:], '\'')
+			if end < 0 {
+				return nil, UnclosedQuoteErr
+			}
+			word.Parts = append(word.Parts, &SglQuoted{Value: l.input[l.offset : l.offset+end]})
+			l.advance(end + 1)
+
+		case '"':
+			flush()
+			l.advance(1)
+			parts, err := l.lexDoubleQuoted(false)
+			if err != nil {
+				return nil, err
+			}
+			word.Parts = append(word.Parts, &DblQuoted{Parts: parts})
+
+		case '\\':
+			switch {
+			case l.peekByte(1) == '\n':
+				// line continuation
+				l.advance(2)
+			case l.offset+1 < len(l.input):
+				flush()
+				word.Parts = append(word.Parts, &SglQuoted{Value: l.input[l.offset+1 : l.offset+2]})
+				l.advance(2)
+			default:
+				lit.WriteByte(ch)
+				l.advance(1)
+			}
+
+		case '`':
+			flush()
+			part, err := l.lexBackquoted(false)
+			if err != nil {
+				return nil, err
+			}
+			word.Parts = append(word.Parts, part)
+
+		case '$':
+			part, err := l.lexDollar(false)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				lit.WriteByte(ch)
+				l.advance(1)
+				continue
+			}
+			flush()
+			word.Parts = append(word.Parts, part)
+
+		default:
+			lit.WriteByte(ch)
+			l.advance(1)
+		}
+	}
+	flush()
+	return word, nil
+}
+
+// lexDoubleQuoted lexes the parts of a double quoted string up to and
+// including the closing quote. A here-document body is lexed the same way,
+// except that it ends with the input and '"' isn't special.
+func (l *Lexer) lexDoubleQuoted(heredoc bool) ([]WordPart, error) {
+	var parts []WordPart
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			parts = append(parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for {
+		if l.eof() {
+			if heredoc {
+				flush()
+				return parts, nil
+			}
+			return nil, UnclosedQuoteErr
+		}
+
+		ch := l.peekByte(0)
+		switch {
+		case ch == '"' && !heredoc:
+			l.advance(1)
+			flush()
+			return parts, nil
+
+		case ch == '\\':
+			next := l.peekByte(1)
+			switch {
+			case next == '\n':
+				l.advance(2)
+			case next == '$' || next == '`' || next == '\\' || (next == '"' && !heredoc):
+				lit.WriteByte(next)
+				l.advance(2)
+			default:
+				lit.WriteByte(ch)
+				l.advance(1)
+			}
+
+		case ch == '`':
+			flush()
+			part, err := l.lexBackquoted(true)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+
+		case ch == '$':
+			part, err := l.lexDollar(true)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				lit.WriteByte(ch)
+				l.advance(1)
+				continue
+			}
+			flush()
+			parts = append(parts, part)
+
+		default:
+			lit.WriteByte(ch)
+			l.advance(1)
+		}
+	}
+}
+
+// lexDollar lexes the expansion introduced by the '$' at the current offset.
+// It returns nil if the '$' is to be taken literally.
+func (l *Lexer) lexDollar(inDbl bool) (WordPart, error) {
+	next := l.peekByte(1)
+	switch {
+	case next == '{':
+		return l.lexBraced(inDbl)
+	case next == '(' && l.peekByte(2) == '(':
+		expr, ok, err := l.lexArith(3)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &ArithExp{Expr: expr}, nil
+		}
+		// e.g. `$((cmd) | filter)`
+		return l.lexCmdSubst()
+	case next == '(':
+		return l.lexCmdSubst()
+	case isSpecialParam(next) || isDigit(next):
+		l.advance(2)
+		return &ParamExp{Name: string(next)}, nil
+	case isNameStart(next):
+		l.advance(1)
+		return &ParamExp{Name: l.lexName()}, nil
+	}
+	return nil, nil
+}
+
+// lexBraced lexes a parameter expansion in braces, e.g. `${name:-word}`.
+func (l *Lexer) lexBraced(inDbl bool) (WordPart, error) {
+	start := l.offset
+	l.advance(2)
+	exp := &ParamExp{Braced: true}
+
+	if l.peekByte(0) == '#' && l.peekByte(1) != '}' {
+		exp.Length = true
+		l.advance(1)
+	}
+
+	switch ch := l.peekByte(0); {
+	case isNameStart(ch):
+		exp.Name = l.lexName()
+		if l.peekByte(0) == '[' {
+			index, err := l.lexIndex(start)
+			if err != nil {
+				return nil, err
+			}
+			exp.Index = index
+		}
+	case isDigit(ch):
+		for isDigit(l.peekByte(0)) {
+			exp.Name += string(l.peekByte(0))
+			l.advance(1)
+		}
+	case isSpecialParam(ch):
+		exp.Name = string(ch)
+		l.advance(1)
+	}
+
+	if l.peekByte(0) == '}' && exp.Name != "" {
+		l.advance(1)
+		return exp, nil
+	}
+	if exp.Name == "" || exp.Length {
+		return nil, l.badSubstitution(start)
+	}
+
+	for _, op := range []string{":-", ":=", ":?", ":+", "-", "=", "?", "+", "##", "#", "%%", "%"} {
+		if strings.HasPrefix(l.input[l.offset:], op) {
+			exp.Op = op
+			break
+		}
+	}
+	if exp.Op == "" {
+		return nil, l.badSubstitution(start)
+	}
+	pos := l.pos()
+	l.advance(len(exp.Op))
+
+	parts, err := l.lexBraceWord(inDbl)
+	if err != nil {
+		return nil, err
+	}
+	exp.Word = &Word{Position: pos, Parts: parts}
+	return exp, nil
+}
+
+// lexIndex lexes the subscript of an array element in brackets, which is
+// expanded like an arithmetic expression.
+func (l *Lexer) lexIndex(start int) (*Word, error) {
+	end := strings.IndexByte(l.input[l.offset:], ']')
+	if end < 0 {
+		return nil, l.badSubstitution(start)
+	}
+	l.advance(1)
+	pos := l.pos()
+	parts, err := newLexer(l.input[l.offset : l.offset+end-1]).lexDoubleQuoted(true)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return nil, l.badSubstitution(start)
+	}
+	l.advance(end)
+	return &Word{Position: pos, Parts: parts}, nil
+}
+
+func (l *Lexer) badSubstitution(start int) error {
+	end := strings.IndexByte(l.input[start:], '}')
+	if end < 0 {
+		return UnclosedQuoteErr
+	}
+	return NewBadSubstitutionError(l.input[start : start+end+1])
+}
+
+// lexBraceWord lexes the word of a parameter expansion operator up to and
+// including the closing brace. Blanks are part of the word and quotes nest
+// inside double quotes.
+func (l *Lexer) lexBraceWord(inDbl bool) ([]WordPart, error) {
+	var parts []WordPart
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			parts = append(parts, &Lit{Value: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for {
+		if l.eof() {
+			return nil, UnclosedQuoteErr
+		}
+
+		ch := l.peekByte(0)
+		switch {
+		case ch == '}':
+			l.advance(1)
+			flush()
+			return parts, nil
+
+		case ch == '\\':
+			next := l.peekByte(1)
+			switch {
+			case next == '\n':
+				l.advance(2)
+			case l.offset+1 >= len(l.input):
+				lit.WriteByte(ch)
+				l.advance(1)
+			case !inDbl:
+				flush()
+				parts = append(parts, &SglQuoted{Value: string(next)})
+				l.advance(2)
+			case next == '$' || next == '`' || next == '\\' || next == '"' || next == '}':
+				lit.WriteByte(next)
+				l.advance(2)
+			default:
+				lit.WriteByte(ch)
+				l.advance(1)
+			}
+
+		case ch == '\'' && !inDbl:
+			flush()
+			l.advance(1)
+			end := strings.IndexByte(l.input[l.offset:], '\'')
+			if end < 0 {
+				return nil, UnclosedQuoteErr
+			}
+			parts = append(parts, &SglQuoted{Value: l.input[l.offset : l.offset+end]})
+			l.advance(end + 1)
+
+		case ch == '"':
+			flush()
+			l.advance(1)
+			dqParts, err := l.lexDoubleQuoted(false)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, &DblQuoted{Parts: dqParts})
+
+		case ch == '`':
+			flush()
+			part, err := l.lexBackquoted(inDbl)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+
+		case ch == '$':
+			part, err := l.lexDollar(inDbl)
+			if err != nil {
+				return nil, err
+			}
+			if part == nil {
+				lit.WriteByte(ch)
+				l.advance(1)
+				continue
+			}
+			flush()
+			parts = append(parts, part)
+
+		default:
+			lit.WriteByte(ch)
+			l.advance(1)
+		}
+	}
+}
+
+// lexCmdSubst lexes a command substitution `$(...)`. The commands are parsed
+// right away, sharing the lexer, up to the closing parenthesis.
+func (l *Lexer) lexCmdSubst() (WordPart, error) {
+	l.advance(2)
+	start := l.offset
+
+	p := &Parser{lexer: l}
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == EOFToken {
+		return nil, UnclosedQuoteErr
+	}
+	if tok.kind != OperatorToken || tok.op != ")" {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	return &CmdSubst{Body: list, Source: l.input[start : l.offset-1]}, nil
+}
+
+// lexArith lexes an arithmetic expression following the skip bytes opening
+// it up to the closing "))". ok is false if the parentheses don't pair up
+// that way, e.g. in `$((cmd) | filter)`, and nothing is consumed then.
+func (l *Lexer) lexArith(skip int) (expr *Word, ok bool, err error) {
+	start := l.offset + skip
+	depth := 0
+	for i := start; i < len(l.input); i++ {
+		switch l.input[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if i+1 == len(l.input) {
+				return nil, false, UnclosedQuoteErr
+			}
+			if l.input[i+1] != ')' {
+				return nil, false, nil
+			}
+
+			l.advance(skip)
+			pos := l.pos()
+			parts, err := newLexer(l.input[start:i]).lexDoubleQuoted(true)
+			if err != nil {
+				return nil, false, err
+			}
+			l.advance(i + 2 - l.offset)
+			return &Word{Position: pos, Parts: parts}, true, nil
+		}
+	}
+	return nil, false, UnclosedQuoteErr
+}
+
+// lexBackquoted lexes a backquoted command substitution. Up to the closing
+// backquote a backslash only escapes '$', '`', '\' and, in double quotes,
+// '"', the resulting text is then parsed as commands.
+func (l *Lexer) lexBackquoted(inDbl bool) (WordPart, error) {
+	l.advance(1)
+	var src strings.Builder
+
+	for {
+		if l.eof() {
+			return nil, UnclosedQuoteErr
+		}
+		ch := l.peekByte(0)
+		if ch == '`' {
+			l.advance(1)
+			break
+		}
+		if next := l.peekByte(1); ch == '\\' && (next == '$' || next == '`' || next == '\\' || (next == '"' && inDbl)) {
+			src.WriteByte(next)
+			l.advance(2)
+			continue
+		}
+		src.WriteByte(ch)
+		l.advance(1)
+	}
+
+	list, err := parse(src.String())
+	if err != nil {
+		return nil, err
+	}
+	return &CmdSubst{Body: list, Source: src.String(), Backquoted: true}, nil
+}
+
+func (l *Lexer) lexName() string {
+	start := l.offset
+	for isNameStart(l.peekByte(0)) || isDigit(l.peekByte(0)) {
+		l.advance(1)
+	}
+	return l.input[start:l.offset]
+}
+
+// isName reports whether s is a valid variable name.
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameStart(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// isSpecialParam reports whether ch names a special parameter like `$?`.
+func isSpecialParam(ch byte) bool {
+	switch ch {
+	case '?', '$', '#', '@', '*':
+		return true
+	}
+	return false
+}
+
+// readHeredocs reads the bodies of the pending here-documents, in the order
+// of their redirections, from the lines following the current one.
+func (l *Lexer) readHeredocs() error {
+	for len(l.heredocs) > 0 {
+		redirect := l.heredocs[0]
+		delim, quoted := redirect.Target.unquoted()
+		stripTabs := redirect.Op == "<<-"
+
+		pos := l.pos()
+		var body strings.Builder
+		for {
+			if l.eof() {
+				return HeredocPendingErr
+			}
+
+			end := strings.IndexByte(l.input[l.offset:], '\n')
+			if end < 0 {
+				end = len(l.input) - l.offset
+			} else {
+				end++
+			}
+			line := l.input[l.offset : l.offset+end]
+			l.advance(end)
+
+			if stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if strings.TrimRight(line, "\r\n") == delim {
+				break
+			}
+			body.WriteString(line)
+		}
+
+		word, err := heredocWord(body.String(), pos, quoted)
+		if incomplete(err) {
+			// the body ends with the delimiter, more input can't
+			// complete it
+			err = NewUnexpectedTokenError(redirect.Position, "EOF")
+		}
+		if err != nil {
+			return err
+		}
+		redirect.Heredoc = word
+		l.heredocs = l.heredocs[1:]
+	}
+	return nil
+}
+
+// heredocWord turns the body of a here-document starting at pos into a
+// word. Unless the delimiter is quoted, the body is subject to expansions
+// and a backslash escapes \, $ and ` and joins a line with the next one.
+func heredocWord(body string, pos Pos, quoted bool) (*Word, error) {
+	if quoted {
+		return &Word{Parts: []WordPart{&SglQuoted{Value: body}}}, nil
+	}
+	l := newLexer(body)
+	l.line, l.col = pos.Line, pos.Col
+	parts, err := l.lexDoubleQuoted(true)
+	if err != nil {
+		return nil, err
+	}
+	return &Word{Parts: []WordPart{&DblQuoted{Parts: parts}}}, nil
+}
@@ -7,12 +7,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"syscall"
 )
 
 const regularPrompt = "$ "
 const awaitPrompt = "> "
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs the shell until `exit` and returns the status to exit with.
+func run() int {
 	signalC := make(chan os.Signal, 1)
 	signal.Notify(signalC, os.Interrupt)
 	ctx, cancelCtx := context.WithCancel(context.Background())
@@ -27,13 +33,22 @@ func main() {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 	}
 
+	shell := NewShell(ctx)
+	shell.sigint = signalC
+	shell.initJobControl(int(os.Stdin.Fd()))
 	for {
-		err := cmdLifecycle(ctx, history)
+		err := cmdLifecycle(history, shell)
 		if errors.Is(err, ExitErr) {
-			return
+			return shell.status
 		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			if errors.Is(err, SignalInterruptErr) {
+				shell.status = 128 + int(syscall.SIGINT)
+			} else {
+				// syntax error
+				shell.status = 2
+			}
 		}
 	}
 }
@@ -58,37 +73,26 @@ func loadHistory() (*os.File, error) {
 	return f, nil
 }
 
-func cmdLifecycle(ctx context.Context, history *os.File) error {
-	var shell *Shell
-	var tokens []Token
+func cmdLifecycle(history *os.File, shell *Shell) error {
+	var list *List
 
-	tokenCh := make(chan []Token)
+	listCh := make(chan *List)
 	errorCh := make(chan error, 1)
+	shell.notifyJobs(os.Stderr)
 	fmt.Fprint(os.Stdout, regularPrompt)
 	_ = os.Stdout.Sync()
-	go parseInput(tokenCh, errorCh)
+	go parseInput(listCh, errorCh, history)
 
 	var ok bool
 	select {
 	case err := <-errorCh:
 		return err
-	case tokens, ok = <-tokenCh:
+	case list, ok = <-listCh:
 		if !ok {
 			return nil
 		}
 	}
 
-	cmds := splitAtPipe(tokens)
-	shell, err := NewShell(cmds, ctx)
-	if err != nil {
-		return err
-	}
-
-	switch {
-	case shell.builtin != nil:
-		return shell.runBuiltin()
-	case shell.cmds != nil:
-		return shell.executeCmds()
-	}
-	return nil
+	shell.drainInterrupts()
+	return shell.execute(list)
 }
@@ -1,284 +1,1013 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
+	"slices"
 	"strings"
 )
 
+// Parser is a recursive descent parser building the syntax tree of the input
+// from the tokens of the lexer.
 type Parser struct {
-	tokens       []Token
-	singleQuoted bool
-	doubleQuoted bool
-	pipeComplete bool
+	lexer *Lexer
+	tok   *Token // lookahead, lexed on demand
 }
 
-type Token interface {
-	TokenType()
-	String() string
+func newParser(input string) *Parser {
+	return &Parser{
+		lexer: newLexer(input),
+		tok:   nil,
+	}
 }
 
-type LiteralToken struct {
-	literal string
-}
+// parse parses a complete input. If the input ends in the middle of a
+// command, e.g. inside quotes, after a pipe or before the `fi` of an `if`, one
+// of UnclosedQuoteErr, PipeHasNoTargetErr, HeredocPendingErr or
+// CompoundPendingErr is returned, meaning more input might complete it.
+func parse(input string) (*List, error) {
+	p := newParser(input)
 
-func (t *LiteralToken) TokenType() {}
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
 
-func (t *LiteralToken) String() string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("literalToken{literal: %s}", t.literal))
-	return sb.String()
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind != EOFToken {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	return list, nil
 }
 
-type RedirectToken struct {
-	op string
-	fd int
+// incomplete reports whether err means that the input parsed ended in the
+// middle of a command.
+func incomplete(err error) bool {
+	return errors.Is(err, UnclosedQuoteErr) || errors.Is(err, PipeHasNoTargetErr) ||
+		errors.Is(err, HeredocPendingErr) || errors.Is(err, CompoundPendingErr)
 }
 
-func (t *RedirectToken) TokenType() {}
+// peek returns the next token without consuming it. Tokens are only lexed
+// when needed, so that here-documents are registered with the lexer before
+// the newline preceding their body is reached.
+func (p *Parser) peek() (Token, error) {
+	if p.tok == nil {
+		tok, err := p.lexer.next()
+		if err != nil {
+			return Token{}, err
+		}
+		p.tok = &tok
+	}
+	return *p.tok, nil
+}
 
-func (t *RedirectToken) String() string {
-	var sb strings.Builder
-	s := fmt.Sprintf("redirectOp{op: %s, fd: %d}", t.op, t.fd)
-	sb.WriteString(s)
-	return sb.String()
+func (p *Parser) advance() {
+	p.tok = nil
 }
 
-func newLiteralToken(s string) Token {
-	var t Token
-	t = &LiteralToken{s}
-	return t
+func (p *Parser) peekOp() (string, error) {
+	tok, err := p.peek()
+	if err != nil || tok.kind != OperatorToken {
+		return "", err
+	}
+	return tok.op, nil
 }
 
-func newRedirectToken(op string, fd int) Token {
-	var t Token
-	t = &RedirectToken{op: op, fd: fd}
-	return t
+// skipNewlines skips newlines and reports whether the input continues after
+// them.
+func (p *Parser) skipNewlines() (bool, error) {
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return false, err
+		}
+		switch tok.kind {
+		case NewlineToken:
+			p.advance()
+		case EOFToken:
+			return false, nil
+		default:
+			return true, nil
+		}
+	}
 }
 
-func newParser() *Parser {
-	return &Parser{
-		tokens:       nil,
-		singleQuoted: false,
-		doubleQuoted: false,
-		pipeComplete: true,
+// parseList parses and-or lists separated by ';', '&' or newlines up to the
+// first token that can't start a command.
+func (p *Parser) parseList() (*List, error) {
+	list := &List{}
+
+	for {
+		more, err := p.skipNewlines()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return list, nil
+		}
+
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !startsCommand(tok) {
+			return list, nil
+		}
+
+		start := tok.offset
+		andOr, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, andOr)
+
+		tok, err = p.peek()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Source = p.source(start)
+		switch {
+		case tok.kind == OperatorToken && tok.op == ";":
+			p.advance()
+		case tok.kind == OperatorToken && tok.op == "&":
+			andOr.Background = true
+			p.advance()
+		case tok.kind == NewlineToken, tok.kind == EOFToken:
+		default:
+			return list, nil
+		}
+	}
+}
+
+// source returns the input from offset start up to the next token.
+func (p *Parser) source(start int) string {
+	tok, err := p.peek()
+	if err != nil {
+		return ""
 	}
+	return strings.TrimSpace(p.lexer.input[start:tok.offset])
+}
+
+// reservedWords are the words with a meaning of their own where a command
+// name would be, as long as they're unquoted.
+var reservedWords = []string{
+	"if", "then", "elif", "else", "fi", "while", "until", "for", "in", "do", "done",
+	"case", "esac", "function", "{", "}", "!", "time",
 }
 
-func (p *Parser) state() string {
-	tokens := []Token{}
+// closingWords are the reserved words ending the list before them.
+var closingWords = []string{"then", "elif", "else", "fi", "do", "done", "esac", "}"}
 
-	if p.tokens != nil {
-		tokens = p.tokens
+// reserved returns the reserved word tok is, if any.
+func reserved(tok Token) string {
+	if tok.kind != WordToken {
+		return ""
+	}
+	s, ok := tok.word.lit()
+	if !ok || !slices.Contains(reservedWords, s) {
+		return ""
 	}
-	return fmt.Sprintf("tokens: %v, singleQuoted: %v, doubleQuoted: %v, pipeComplete: %v", tokens, p.singleQuoted, p.doubleQuoted, p.pipeComplete)
+	return s
 }
 
-func (p *Parser) parse(input string) error {
-	arg := []byte{}
+func startsCommand(tok Token) bool {
+	switch tok.kind {
+	case WordToken:
+		return !slices.Contains(closingWords, reserved(tok))
+	case IONumberToken:
+		return true
+	case OperatorToken:
+		return isRedirectOp(tok.op) || tok.op == "("
+	}
+	return false
+}
+
+func (p *Parser) parseAndOr() (*AndOr, error) {
+	pipeline, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	andOr := &AndOr{Pipelines: []*Pipeline{pipeline}}
 
-	i := 0
 	for {
-		if i == len(input) {
-			break
+		op, err := p.peekOp()
+		if err != nil {
+			return nil, err
+		}
+		if op != "&&" && op != "||" {
+			return andOr, nil
 		}
-		ch := input[i]
-		switch ch {
-		case '|':
+		p.advance()
 
-			if len(p.tokens) == 0 && len(arg) == 0 {
-				return NewUnexpectedTokenError("|")
-			}
+		// same as a pipe, a list can't end with '&&' or '||'
+		if more, err := p.skipNewlines(); err != nil {
+			return nil, err
+		} else if !more {
+			return nil, PipeHasNoTargetErr
+		}
 
-			if len(arg) > 0 {
-				token := newLiteralToken(string(arg))
-				p.tokens = append(p.tokens, token)
-				arg = arg[:0]
-			}
+		pipeline, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Ops = append(andOr.Ops, op)
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+	}
+}
 
-			token := newLiteralToken(("|"))
-			p.tokens = append(p.tokens, token)
-			p.pipeComplete = false
-			i++
-
-		case '>':
-			// 2454>
-			// 2454>|
-			// >|
-			// >
-
-			if !p.doubleQuoted && !p.singleQuoted {
-
-				fd := STDOUT
-				if len(arg) > 0 {
-					if num, err := strconv.Atoi(truncateLeadingZeros(string(arg))); err == nil {
-						fd = num
-						arg = arg[:0]
-					}
+func (p *Parser) parsePipeline() (*Pipeline, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	pipeline := &Pipeline{Position: tok.pos}
+	start := tok.offset
+
+	// `!` and `time [-p]` come before the commands, in any order
+	for prefix := true; prefix; {
+		switch reserved(tok) {
+		case "!":
+			pipeline.Negated = !pipeline.Negated
+			p.advance()
+		case "time":
+			pipeline.Timed = true
+			p.advance()
+			if tok, err = p.peek(); err != nil {
+				return nil, err
+			}
+			if tok.kind == WordToken {
+				if lit, _ := tok.word.lit(); lit == "-p" {
+					pipeline.Posix = true
+					p.advance()
 				}
+			}
+		default:
+			prefix = false
+			continue
+		}
+		if tok, err = p.peek(); err != nil {
+			return nil, err
+		}
+	}
+	if pipeline.Timed && !startsCommand(tok) {
+		// `time` on its own times the empty pipeline
+		pipeline.Source = p.source(start)
+		return pipeline, nil
+	}
 
-				if i+1 < len(input) { // should always be the case cause inputs ends with '\n' but just to be sure
-
-					// FIXME: handle invalid syntax errors like '>>>' or '>>!' (what to do in last case?)
-
-					var j int // next char after the op '>[|]' or '>>'
-					if input[i+1] == '|' {
-						token := newRedirectToken(">|", fd)
-						p.tokens = append(p.tokens, token)
-						j = i + 2
-						i = i + 2
-
-						// FIXME: can pipe follow '>>': '>>[|]'?
-					} else if input[i+1] == '>' {
-						token := newRedirectToken(">>", fd)
-						p.tokens = append(p.tokens, token)
-						j = i + 2
-						i = i + 2
-					} else {
-						token := newRedirectToken(">", fd)
-						p.tokens = append(p.tokens, token)
-						j = i + 1
-						i++
-					}
-
-					// check that '>[|]' is followed by something and doesn't end with '\n'
-					foundNonWhiteSpaceCh := false
-					for ; j < len(input); j++ {
-						if j != ' ' && j != '\t' && j != '\n' {
-							foundNonWhiteSpaceCh = true
-						}
-					}
-					if !foundNonWhiteSpaceCh {
-						return NewUnexpectedTokenError("newline")
-					}
-				}
+	for {
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Cmds = append(pipeline.Cmds, cmd)
 
-			} else if p.doubleQuoted || p.singleQuoted {
-				arg = append(arg, ch)
-				i++
-			}
+		op, err := p.peekOp()
+		if err != nil {
+			return nil, err
+		}
+		if op != "|" {
+			pipeline.Source = p.source(start)
+			return pipeline, nil
+		}
+		p.advance()
 
-		case '\\':
-
-			if !p.doubleQuoted && !p.singleQuoted && i+1 < len(input) {
-				arg = append(arg, input[i+1])
-				i = i + 2
-			} else if p.doubleQuoted && !p.singleQuoted {
-				if i+1 < len(input) && input[i+1] == '$' || input[i+1] == '`' || input[i+1] == '"' || input[i+1] == '\\' {
-					arg = append(arg, input[i+1])
-					i = i + 2
-				} else {
-					arg = append(arg, ch)
-					i++
-				}
-			} else if !p.doubleQuoted && p.singleQuoted {
-				arg = append(arg, ch)
-				i++
-			}
+		if more, err := p.skipNewlines(); err != nil {
+			return nil, err
+		} else if !more {
+			return nil, PipeHasNoTargetErr
+		}
+	}
+}
 
-		case '\'':
+func (p *Parser) parseCommand() (Command, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if !startsCommand(tok) {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	if tok.kind == OperatorToken && tok.op == "(" {
+		if p.lexer.peekByte(0) == '(' {
+			return p.parseArithCmd()
+		}
+		return p.parseSubshell()
+	}
+	switch reserved(tok) {
+	case "if":
+		return p.parseIf()
+	case "while", "until":
+		return p.parseWhile()
+	case "for":
+		return p.parseFor()
+	case "case":
+		return p.parseCase()
+	case "function":
+		return p.parseFunction()
+	case "{":
+		return p.parseBraceGroup()
+	}
+	return p.parseSimpleCommand()
+}
 
-			if p.doubleQuoted && !p.singleQuoted {
-				arg = append(arg, ch)
-			} else if !p.doubleQuoted && p.singleQuoted {
-				p.singleQuoted = false
-			} else if !p.doubleQuoted && !p.singleQuoted {
-				p.singleQuoted = true
-			}
-			i++
+// parseFunction parses `function name [()] body`.
+func (p *Parser) parseFunction() (*FuncDecl, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	pos := tok.pos
 
-		case '"':
+	if tok, err = p.peek(); err != nil {
+		return nil, err
+	}
+	if tok.kind == EOFToken {
+		return nil, CompoundPendingErr
+	}
+	name, ok := funcName(tok)
+	if !ok {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	p.advance()
 
-			if !p.doubleQuoted && p.singleQuoted {
-				arg = append(arg, ch)
-			} else if p.doubleQuoted && !p.singleQuoted {
-				p.doubleQuoted = false
-			} else if !p.doubleQuoted && !p.singleQuoted {
-				p.doubleQuoted = true
-			}
-			i++
+	if op, err := p.peekOp(); err != nil {
+		return nil, err
+	} else if op == "(" {
+		return p.parseFuncDecl(pos, name)
+	}
+	return p.parseFuncBody(pos, name)
+}
+
+// parseFuncDecl parses the rest of `name() body` with the '(' being the
+// lookahead.
+func (p *Parser) parseFuncDecl(pos Pos, name string) (*FuncDecl, error) {
+	p.advance()
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind != OperatorToken || tok.op != ")" {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	p.advance()
+	return p.parseFuncBody(pos, name)
+}
 
-		case ' ', '\t':
+// parseFuncBody parses the compound command making up the body of a
+// function, which may follow on the next line.
+func (p *Parser) parseFuncBody(pos Pos, name string) (*FuncDecl, error) {
+	if more, err := p.skipNewlines(); err != nil {
+		return nil, err
+	} else if !more {
+		return nil, CompoundPendingErr
+	}
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
 
-			if p.singleQuoted || p.doubleQuoted {
-				arg = append(arg, ch)
-			} else if !p.singleQuoted && !p.doubleQuoted {
+	var body Command
+	switch reserved(tok) {
+	case "{":
+		body, err = p.parseBraceGroup()
+	case "if", "while", "until", "for", "case":
+		body, err = p.parseCommand()
+	default:
+		if tok.kind == OperatorToken && tok.op == "(" {
+			body, err = p.parseCommand()
+		} else {
+			err = NewUnexpectedTokenError(tok.pos, tok.String())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FuncDecl{Position: pos, Name: name, Body: body}, nil
+}
 
-				if len(arg) > 0 {
-					token := newLiteralToken(string(arg))
-					p.tokens = append(p.tokens, token)
-				}
-				arg = arg[:0]
+// funcName returns the name of the function tok defines, which has to be an
+// unquoted word other than a reserved one.
+func funcName(tok Token) (string, bool) {
+	if tok.kind != WordToken || reserved(tok) != "" {
+		return "", false
+	}
+	name, ok := tok.word.lit()
+	if !ok || strings.ContainsAny(name, "$=/") {
+		return "", false
+	}
+	return name, true
+}
+
+// parseBraceGroup parses `{ list; }` along with the redirections following
+// it.
+func (p *Parser) parseBraceGroup() (*BraceGroup, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	group := &BraceGroup{Position: tok.pos}
+
+	if group.Body, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if err := p.expectReserved("}"); err != nil {
+		return nil, err
+	}
+	if group.Redirs, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// expectReserved consumes the reserved word word. The input ending before
+// it means the compound command being parsed isn't complete yet.
+func (p *Parser) expectReserved(word string) error {
+	tok, err := p.peek()
+	if err != nil {
+		return err
+	}
+	if tok.kind == EOFToken {
+		return CompoundPendingErr
+	}
+	if reserved(tok) != word {
+		return NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	p.advance()
+	return nil
+}
+
+// parseCompoundList parses the list inside a compound command, which can't
+// be empty.
+func (p *Parser) parseCompoundList() (*List, error) {
+	list, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) > 0 {
+		return list, nil
+	}
+
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == EOFToken {
+		return nil, CompoundPendingErr
+	}
+	return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+}
+
+// parseIf parses an if clause along with the redirections following it.
+func (p *Parser) parseIf() (*IfClause, error) {
+	clause, err := p.parseIfBody()
+	if err != nil {
+		return nil, err
+	}
+	clause.Redirs, err = p.parseRedirects()
+	if err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseIfBody parses the rest of an if clause after `if` or `elif`, which is
+// the lookahead, up to and including `fi`.
+func (p *Parser) parseIfBody() (*IfClause, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	clause := &IfClause{Position: tok.pos}
+
+	if clause.Cond, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if err := p.expectReserved("then"); err != nil {
+		return nil, err
+	}
+	if clause.Then, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+
+	tok, err = p.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch reserved(tok) {
+	case "elif":
+		clause.Else, err = p.parseIfBody()
+		return clause, err
+	case "else":
+		p.advance()
+		clause.Else = &IfClause{Position: tok.pos}
+		if clause.Else.Then, err = p.parseCompoundList(); err != nil {
+			return nil, err
+		}
+	}
+	return clause, p.expectReserved("fi")
+}
+
+// parseWhile parses a while or until loop along with the redirections
+// following it.
+func (p *Parser) parseWhile() (*WhileClause, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	clause := &WhileClause{Position: tok.pos, Until: reserved(tok) == "until"}
+
+	if clause.Cond, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if clause.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	if clause.Redirs, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseFor parses a for loop, either over words or an arithmetic one, along
+// with the redirections following it.
+func (p *Parser) parseFor() (Command, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	pos := tok.pos
+
+	tok, err = p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind == EOFToken {
+		return nil, CompoundPendingErr
+	}
+	if tok.kind == OperatorToken && tok.op == "(" {
+		return p.parseArithFor(pos)
+	}
+
+	name, ok := "", false
+	if tok.kind == WordToken {
+		name, ok = tok.word.lit()
+	}
+	if !ok || !isName(name) {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	p.advance()
+	clause := &ForClause{Position: pos, Name: name}
+
+	op, err := p.peekOp()
+	if err != nil {
+		return nil, err
+	}
+	if op == ";" {
+		p.advance()
+	} else if err := p.parseForWords(clause); err != nil {
+		return nil, err
+	}
+
+	if clause.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	if clause.Redirs, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// parseForWords parses the `in words` part of a for loop, if any, up to and
+// including the ';' or newline ending it.
+func (p *Parser) parseForWords(clause *ForClause) error {
+	if more, err := p.skipNewlines(); err != nil {
+		return err
+	} else if !more {
+		return CompoundPendingErr
+	}
+	tok, err := p.peek()
+	if err != nil {
+		return err
+	}
+	if reserved(tok) != "in" {
+		return nil
+	}
+	p.advance()
+
+	clause.Words = []*Word{}
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return err
+		}
+		switch {
+		case tok.kind == WordToken:
+			clause.Words = append(clause.Words, tok.word)
+			p.advance()
+		case tok.kind == NewlineToken, tok.kind == OperatorToken && tok.op == ";":
+			p.advance()
+			return nil
+		case tok.kind == EOFToken:
+			return CompoundPendingErr
+		default:
+			return NewUnexpectedTokenError(tok.pos, tok.String())
+		}
+	}
+}
+
+// parseArithFor parses the rest of `for ((init; cond; post))`, with the first
+// '(' being the lookahead.
+func (p *Parser) parseArithFor(pos Pos) (*ArithForClause, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := p.parseArithCmd()
+	if err != nil {
+		return nil, err
+	}
+	cmd, ok := parsed.(*ArithCmd)
+	if !ok {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	exprs := splitArithFor(cmd.Expr)
+	if len(exprs) != 3 {
+		expr, _ := cmd.Expr.unquoted()
+		return nil, NewUnexpectedTokenError(cmd.Position, "(("+expr+"))")
+	}
+	clause := &ArithForClause{Position: pos, Init: exprs[0], Cond: exprs[1], Post: exprs[2]}
+
+	op, err := p.peekOp()
+	if err != nil {
+		return nil, err
+	}
+	if op == ";" {
+		p.advance()
+	}
+	if clause.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	if clause.Redirs, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
+
+// splitArithFor splits the expression of an arithmetic for loop at the
+// unquoted semicolons.
+func splitArithFor(expr *Word) []*Word {
+	exprs := []*Word{{Position: expr.Position}}
+	for _, part := range expr.Parts {
+		lit, ok := part.(*Lit)
+		if !ok {
+			last := exprs[len(exprs)-1]
+			last.Parts = append(last.Parts, part)
+			continue
+		}
+		for i, s := range strings.Split(lit.Value, ";") {
+			if i > 0 {
+				exprs = append(exprs, &Word{Position: expr.Position})
 			}
-			i++
-
-		case '\n', '\r':
-
-			if p.singleQuoted || p.doubleQuoted {
-				// prompt user for more input: incomplete/invalid echo command!
-				arg = append(arg, ch)
-				token := newLiteralToken(string(arg))
-				p.tokens = append(p.tokens, token)
-				arg = arg[:0]
-				return UnclosedQuoteErr
-
-			} else if !p.singleQuoted && !p.doubleQuoted {
-				// we are done
-				if len(arg) > 0 {
-					token := newLiteralToken(string(arg))
-					p.tokens = append(p.tokens, token)
-				}
-				arg = arg[:0]
+			if s != "" {
+				last := exprs[len(exprs)-1]
+				last.Parts = append(last.Parts, &Lit{Value: s})
 			}
+		}
+	}
+	return exprs
+}
 
-			if !p.pipeComplete {
-				return PipeHasNoTargetErr
-			}
+// parseDoGroup parses `do list; done`, skipping newlines before `do`.
+func (p *Parser) parseDoGroup() (*List, error) {
+	if more, err := p.skipNewlines(); err != nil {
+		return nil, err
+	} else if !more {
+		return nil, CompoundPendingErr
+	}
+	if err := p.expectReserved("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseCompoundList()
+	if err != nil {
+		return nil, err
+	}
+	return body, p.expectReserved("done")
+}
+
+// parseCase parses a case clause along with the redirections following it.
+func (p *Parser) parseCase() (*CaseClause, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	clause := &CaseClause{Position: tok.pos}
+
+	if tok, err = p.peek(); err != nil {
+		return nil, err
+	}
+	switch tok.kind {
+	case EOFToken:
+		return nil, CompoundPendingErr
+	case WordToken:
+		clause.Word = tok.word
+		p.advance()
+	default:
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+
+	if more, err := p.skipNewlines(); err != nil {
+		return nil, err
+	} else if !more {
+		return nil, CompoundPendingErr
+	}
+	if err := p.expectReserved("in"); err != nil {
+		return nil, err
+	}
+
+	for {
+		if more, err := p.skipNewlines(); err != nil {
+			return nil, err
+		} else if !more {
+			return nil, CompoundPendingErr
+		}
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if reserved(tok) == "esac" {
+			p.advance()
+			break
+		}
+
+		item, err := p.parseCaseItem()
+		if err != nil {
+			return nil, err
+		}
+		clause.Items = append(clause.Items, item)
+	}
+
+	if clause.Redirs, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return clause, nil
+}
 
-			i++
+// parseCaseItem parses the patterns of a case item, its list and the
+// operator ending it, which the last item before `esac` may leave out.
+func (p *Parser) parseCaseItem() (*CaseItem, error) {
+	item := &CaseItem{Op: ";;"}
 
+	if op, err := p.peekOp(); err != nil {
+		return nil, err
+	} else if op == "(" {
+		p.advance()
+	}
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch tok.kind {
+		case EOFToken:
+			return nil, CompoundPendingErr
+		case WordToken:
+			item.Patterns = append(item.Patterns, tok.word)
+			p.advance()
 		default:
-			if !p.pipeComplete {
-				p.pipeComplete = true
-			}
-			arg = append(arg, ch)
-			i++
+			return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+		}
+
+		tok, err = p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == EOFToken {
+			return nil, CompoundPendingErr
+		}
+		if tok.kind != OperatorToken || (tok.op != "|" && tok.op != ")") {
+			return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+		}
+		p.advance()
+		if tok.op == ")" {
+			break
 		}
 	}
-	if endsWithRedirectOp(p.tokens) {
-		return fmt.Errorf("Broken redirect")
+
+	var err error
+	if item.Body, err = p.parseList(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tok.kind == OperatorToken && (tok.op == ";;" || tok.op == ";&" || tok.op == ";;&"):
+		item.Op = tok.op
+		p.advance()
+	case tok.kind == EOFToken:
+		return nil, CompoundPendingErr
+	case reserved(tok) != "esac":
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	return item, nil
 }
 
-func endsWithRedirectOp(tokens []Token) bool {
-	n := len(tokens)
-	if n == 0 {
-		return false
+// parseRedirects parses the redirections following a compound command.
+func (p *Parser) parseRedirects() ([]*Redirect, error) {
+	var redirects []*Redirect
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind != IONumberToken && (tok.kind != OperatorToken || !isRedirectOp(tok.op)) {
+			return redirects, nil
+		}
+		redirect, err := p.parseRedirect()
+		if err != nil {
+			return nil, err
+		}
+		redirects = append(redirects, redirect)
 	}
-	if _, ok := tokens[n-1].(*RedirectToken); ok {
-		return true
+}
+
+// parseArithCmd parses `((expr))`, with the first '(' being the lookahead.
+// If the parentheses don't pair up that way, it's a subshell inside another
+// one instead, e.g. `((cd dir; ls) | wc)`.
+func (p *Parser) parseArithCmd() (Command, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
 	}
-	return false
+	if p.lexer.peekByte(0) != '(' {
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+
+	expr, ok, err := p.lexer.lexArith(1)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return p.parseSubshell()
+	}
+	p.advance()
+	return &ArithCmd{Position: tok.pos, Expr: expr}, nil
+}
+
+// parseSubshell parses `( list )` along with the redirections following it.
+func (p *Parser) parseSubshell() (*Subshell, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.advance()
+	subshell := &Subshell{Position: tok.pos}
+
+	if subshell.Body, err = p.parseCompoundList(); err != nil {
+		return nil, err
+	}
+	if tok, err = p.peek(); err != nil {
+		return nil, err
+	}
+	switch {
+	case tok.kind == EOFToken:
+		return nil, CompoundPendingErr
+	case tok.kind != OperatorToken || tok.op != ")":
+		return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+	}
+	p.advance()
+
+	if subshell.Redirs, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return subshell, nil
 }
 
-func truncateLeadingZeros(s string) string {
-	if len(s) == 0 {
-		return s
+// parseSimpleCommand parses a simple command, or a function definition if
+// its first word is followed by "()".
+func (p *Parser) parseSimpleCommand() (Command, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
 	}
+	cmd := &SimpleCmd{Position: tok.pos}
 
-	var sb strings.Builder
-	leadingZeros := true
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
 
-	for _, ch := range s {
-		if ch == '0' && leadingZeros {
-			continue
+		switch {
+		case tok.kind == WordToken && len(cmd.Args) == 0:
+			// assignments precede the command name
+			if assign, ok := parseAssign(tok.word); ok {
+				cmd.Assigns = append(cmd.Assigns, assign)
+			} else {
+				cmd.Args = append(cmd.Args, tok.word)
+			}
+			p.advance()
+		case tok.kind == WordToken:
+			cmd.Args = append(cmd.Args, tok.word)
+			p.advance()
+		case tok.kind == OperatorToken && tok.op == "(" && len(cmd.Args) == 1 && len(cmd.Assigns) == 0 && len(cmd.Redirs) == 0:
+			name, ok := funcName(Token{kind: WordToken, word: cmd.Args[0]})
+			if !ok {
+				return nil, NewUnexpectedTokenError(tok.pos, tok.String())
+			}
+			return p.parseFuncDecl(cmd.Position, name)
+		case tok.kind == IONumberToken || (tok.kind == OperatorToken && isRedirectOp(tok.op)):
+			redirect, err := p.parseRedirect()
+			if err != nil {
+				return nil, err
+			}
+			cmd.Redirs = append(cmd.Redirs, redirect)
+		default:
+			return cmd, nil
+		}
+	}
+}
+
+// parseAssign returns the assignment a word of the form `name=value` stands
+// for, with the name unquoted.
+func parseAssign(word *Word) (*Assign, bool) {
+	if len(word.Parts) == 0 {
+		return nil, false
+	}
+	lit, ok := word.Parts[0].(*Lit)
+	if !ok {
+		return nil, false
+	}
+	name, value, found := strings.Cut(lit.Value, "=")
+	if !found || !isName(name) {
+		return nil, false
+	}
+
+	parts := word.Parts[1:]
+	if value != "" {
+		parts = append([]WordPart{&Lit{Value: value}}, parts...)
+	}
+	valuePos := Pos{Line: word.Position.Line, Col: word.Position.Col + len(name) + 1}
+	return &Assign{
+		Position: word.Position,
+		Name:     name,
+		Value:    &Word{Position: valuePos, Parts: parts},
+	}, true
+}
+
+// parseRedirect parses a redirection operator with an optional fd before it
+// and its target after it.
+func (p *Parser) parseRedirect() (*Redirect, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	redirect := &Redirect{Position: tok.pos, Fd: -1}
+
+	if tok.kind == IONumberToken {
+		redirect.Fd = tok.fd
+		p.advance()
+		if tok, err = p.peek(); err != nil {
+			return nil, err
 		}
-		sb.WriteRune(ch)
-		leadingZeros = false
 	}
-	return sb.String()
+	redirect.Op = tok.op
+	p.advance()
+
+	if redirect.Fd < 0 {
+		redirect.Fd = STDOUT
+		if strings.HasPrefix(redirect.Op, "<") {
+			redirect.Fd = STDIN
+		}
+	}
+
+	target, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if target.kind != WordToken {
+		return nil, NewUnexpectedTokenError(target.pos, target.String())
+	}
+	redirect.Target = target.word
+	p.advance()
+
+	if redirect.Op == "<<" || redirect.Op == "<<-" {
+		// the body follows the current line
+		p.lexer.heredocs = append(p.lexer.heredocs, redirect)
+	}
+	return redirect, nil
 }
 
 func notFound(input string) string {
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// matchPattern reports whether s matches the shell pattern, where '*'
+// matches any string, '?' any character and a bracket expression like
+// `[a-z]` or `[!0-9]` any character of the set. A backslash makes the
+// character following it match literally.
+func matchPattern(pattern string, s string) bool {
+	return matchRunes([]rune(pattern), []rune(s))
+}
+
+func matchRunes(pattern []rune, s []rune) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchRunes(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest, ok := matchBracket(pattern, s[0])
+			if !ok {
+				// not a bracket expression, '[' is taken literally
+				if s[0] != '[' {
+					return false
+				}
+				pattern, s = pattern[1:], s[1:]
+				continue
+			}
+			if !matched {
+				return false
+			}
+			pattern, s = rest, s[1:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchBracket matches ch against the bracket expression pattern starts
+// with and returns the pattern following it. ok is false if the bracket
+// isn't closed.
+func matchBracket(pattern []rune, ch rune) (matched bool, rest []rune, ok bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+
+	for first := true; i < len(pattern); first = false {
+		c := pattern[i]
+		if c == ']' && !first {
+			return matched != negate, pattern[i+1:], true
+		}
+
+		if c == '[' && i+1 < len(pattern) && pattern[i+1] == ':' {
+			if end := classEnd(pattern, i+2); end >= 0 {
+				if matchClass(string(pattern[i+2:end]), ch) {
+					matched = true
+				}
+				i = end + 2
+				continue
+			}
+		}
+
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+		lo, hi := c, c
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			if hi == '\\' && i+3 < len(pattern) {
+				i++
+				hi = pattern[i+2]
+			}
+			i += 2
+		}
+		if lo <= ch && ch <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, nil, false
+}
+
+// classEnd returns the index of the ":]" closing a character class name
+// starting at i, or -1.
+func classEnd(pattern []rune, i int) int {
+	for ; i+1 < len(pattern); i++ {
+		if pattern[i] == ':' && pattern[i+1] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+func matchClass(class string, ch rune) bool {
+	switch class {
+	case "alpha":
+		return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+	case "digit":
+		return ch >= '0' && ch <= '9'
+	case "alnum":
+		return matchClass("alpha", ch) || matchClass("digit", ch)
+	case "upper":
+		return ch >= 'A' && ch <= 'Z'
+	case "lower":
+		return ch >= 'a' && ch <= 'z'
+	case "space":
+		return ch == ' ' || (ch >= '\t' && ch <= '\r')
+	case "blank":
+		return ch == ' ' || ch == '\t'
+	case "punct":
+		return ch > ' ' && ch < 0x7f && !matchClass("alnum", ch)
+	case "xdigit":
+		return matchClass("digit", ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+	}
+	return false
+}
+
+// escapePattern escapes the pattern characters of s so that it matches
+// itself only, which is how quoted text takes part in a pattern.
+func escapePattern(s string) string {
+	var sb strings.Builder
+	for _, ch := range s {
+		switch ch {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}
+
+// hasGlobMeta reports whether pattern contains unescaped pattern characters,
+// '[' only counting if a ']' follows it.
+func hasGlobMeta(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?':
+			return true
+		case '[':
+			if strings.IndexByte(pattern[i+1:], ']') >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unescapePattern removes the backslashes escaping characters in pattern.
+func unescapePattern(pattern string) string {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		sb.WriteByte(pattern[i])
+	}
+	return sb.String()
+}
+
+// glob returns the sorted paths matching pattern, matching each of its '/'
+// separated components against the directory entries. A name starting with
+// '.' only matches a component starting with '.' as well. Relative paths
+// are looked up in dir.
+func glob(dir string, pattern string) []string {
+	paths := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		paths = []string{"/"}
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+
+	components := strings.Split(pattern, "/")
+	for i, component := range components {
+		last := i == len(components)-1
+		var next []string
+
+		for _, path := range paths {
+			switch {
+			case component == "" && last:
+				// trailing '/': directories only
+				if info, err := os.Stat(inDir(dir, path)); err == nil && info.IsDir() {
+					next = append(next, path)
+				}
+			case component == "":
+				next = append(next, path)
+			case !hasGlobMeta(component):
+				name := path + unescapePattern(component)
+				if _, err := os.Lstat(inDir(dir, name)); err == nil || !last {
+					next = append(next, name)
+				}
+			default:
+				entries, err := os.ReadDir(inDir(dir, path+"."))
+				if err != nil {
+					continue
+				}
+				for _, entry := range entries {
+					name := entry.Name()
+					if strings.HasPrefix(name, ".") && !strings.HasPrefix(component, ".") && !strings.HasPrefix(component, "\\.") {
+						continue
+					}
+					if matchPattern(component, name) {
+						next = append(next, path+name)
+					}
+				}
+			}
+		}
+
+		if !last {
+			for j := range next {
+				if !strings.HasSuffix(next[j], "/") {
+					next[j] += "/"
+				}
+			}
+		}
+		paths = next
+	}
+
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// redirect is a redirection with its target expanded. For here-documents
+// the target is the body.
+type redirect struct {
+	op     string
+	fd     int
+	target string
+}
+
+// fdTable is the redirection table of a single command. It maps the fds of
+// the command to the streams backing them and keeps track of the files opened
+// by the redirections so that they can be closed once the command is done.
+// Relative targets are opened in dir.
+type fdTable struct {
+	fds    map[int]any
+	opened []*os.File
+	dir    string
+}
+
+func newFdTable(dir string, stdin io.Reader, stdout io.Writer, stderr io.Writer) *fdTable {
+	return &fdTable{
+		fds:    map[int]any{STDIN: stdin, STDOUT: stdout, STDERR: stderr},
+		opened: nil,
+		dir:    dir,
+	}
+}
+
+// applyAll applies the redirections in order: `>out 2>&1` and `2>&1 >out`
+// differ.
+func (t *fdTable) applyAll(redirects []redirect) error {
+	for _, r := range redirects {
+		if err := t.apply(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply points the fd of r at its target, taking into account the
+// redirections already applied.
+func (t *fdTable) apply(r redirect) error {
+	op := r.op
+	fd := r.fd
+	target := r.target
+
+	if op == ">&" || op == "<&" {
+		if target == "-" {
+			delete(t.fds, fd)
+			return nil
+		}
+		if srcFd, err := strconv.Atoi(target); err == nil {
+			src, ok := t.fds[srcFd]
+			if !ok {
+				return NewBadFdError(srcFd)
+			}
+			t.fds[fd] = src
+			return nil
+		}
+		if op == "<&" || fd != STDOUT {
+			return NewAmbiguousRedirectError(target)
+		}
+		// >&word is the same as &>word
+		op = "&>"
+	}
+
+	if op == "&>" || op == "&>>" {
+		file, err := redirectFd(op[1:], t.dir, target)
+		if err != nil {
+			return err
+		}
+		t.opened = append(t.opened, file)
+		t.fds[STDOUT] = file
+		t.fds[STDERR] = file
+		return nil
+	}
+
+	file, err := redirectFd(op, t.dir, target)
+	if err != nil {
+		return err
+	}
+	t.opened = append(t.opened, file)
+	t.fds[fd] = file
+	return nil
+}
+
+// reader returns the stream fd reads from, if it is open for reading.
+func (t *fdTable) reader(fd int) (io.Reader, error) {
+	r, ok := t.fds[fd].(io.Reader)
+	if !ok {
+		return nil, NewBadFdError(fd)
+	}
+	return r, nil
+}
+
+// writer returns the stream fd writes to, if it is open for writing.
+func (t *fdTable) writer(fd int) (io.Writer, error) {
+	w, ok := t.fds[fd].(io.Writer)
+	if !ok {
+		return nil, NewBadFdError(fd)
+	}
+	return w, nil
+}
+
+// setup hands the fds of the table over to cmd.
+func (t *fdTable) setup(cmd *exec.Cmd) error {
+	var err error
+
+	if cmd.Stdin, err = t.reader(STDIN); err != nil {
+		if cmd.Stdin, err = t.closedFd(os.O_WRONLY); err != nil {
+			return err
+		}
+	}
+	if cmd.Stdout, err = t.writer(STDOUT); err != nil {
+		if cmd.Stdout, err = t.closedFd(os.O_RDONLY); err != nil {
+			return err
+		}
+	}
+	if cmd.Stderr, err = t.writer(STDERR); err != nil {
+		if cmd.Stderr, err = t.closedFd(os.O_RDONLY); err != nil {
+			return err
+		}
+	}
+
+	for fd, f := range t.fds {
+		if fd <= STDERR {
+			continue
+		}
+		file, ok := f.(*os.File)
+		if !ok {
+			return NewBadFdError(fd)
+		}
+		// a nil entry in ExtraFiles is closed in the child
+		for len(cmd.ExtraFiles) <= fd-3 {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+		}
+		cmd.ExtraFiles[fd-3] = file
+	}
+	return nil
+}
+
+// closedFd stands in for a closed standard stream, which exec.Cmd can't leave
+// unset: the null device opened in the wrong mode fails every read or write
+// with EBADF just like a closed fd would.
+func (t *fdTable) closedFd(flag int) (*os.File, error) {
+	file, err := os.OpenFile(os.DevNull, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	t.opened = append(t.opened, file)
+	return file, nil
+}
+
+// close closes every file opened by the redirections.
+func (t *fdTable) close() {
+	closeFiles(t.opened)
+	t.opened = nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		_ = file.Close()
+	}
+}
+
+// redirectFd opens the target of a redirection, a file relative to dir or
+// the body of a here-document.
+func redirectFd(op string, dir string, target string) (*os.File, error) {
+	// TODO: do we validate the fd value?
+	switch op {
+	case "<<<":
+		// here-string: the target word itself followed by a newline
+		return hereString(target + "\n")
+	case "<<", "<<-":
+		// here-document: the target is the body
+		return hereString(target)
+	}
+
+	file, err := openFile(op, inDir(dir, target))
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) && !filepath.IsAbs(target) {
+		// reported relative to dir, the way it was given
+		pathErr.Path = strings.TrimPrefix(pathErr.Path, strings.TrimSuffix(dir, "/")+"/")
+	}
+	return file, err
+}
+
+func openFile(op string, filePath string) (*os.File, error) {
+	switch op {
+	case "<":
+		return os.Open(filePath)
+	case ">":
+		if err := mkParentDirIfAbsent(filePath); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_EXCL|os.O_CREATE, 0644)
+		if errors.Is(err, os.ErrExist) {
+			// only regular files are protected from clobbering,
+			// writing to e.g. /dev/null is fine
+			if info, statErr := os.Stat(filePath); statErr == nil && !info.Mode().IsRegular() {
+				return os.OpenFile(filePath, os.O_WRONLY, 0)
+			}
+		}
+		return file, err
+	case ">|":
+		if err := mkParentDirIfAbsent(filePath); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(filePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	case ">>":
+		return os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	case "<>":
+		// open for both reading and writing, without truncating
+		return os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	default:
+		return nil, UnknownOperatorErr
+	}
+}
+
+// hereString returns the read end of a pipe that yields s and then EOF.
+func hereString(s string) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, _ = io.WriteString(pw, s)
+		_ = pw.Close()
+	}()
+	return pr, nil
+}
+
+func mkParentDirIfAbsent(path string) error {
+	dir := filepath.Dir(path)
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,46 @@
 package main
 
 import (
-	"reflect"
+	"context"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
+func newWordToken(s string) Token {
+	return Token{kind: WordToken, word: &Word{Parts: []WordPart{&Lit{Value: s}}}}
+}
+
+func newOperatorToken(op string) Token {
+	return Token{kind: OperatorToken, op: op}
+}
+
+func newIONumberToken(fd int) Token {
+	return Token{kind: IONumberToken, fd: fd}
+}
+
+func lex(input string) ([]Token, error) {
+	lexer := newLexer(input)
+	tokens := []Token{}
+	for {
+		tok, err := lexer.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == EOFToken {
+			return tokens, nil
+		}
+		if tok.kind != NewlineToken {
+			tokens = append(tokens, tok)
+		}
+	}
+}
+
 func TestTokenization(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -15,41 +51,77 @@ func TestTokenization(t *testing.T) {
 		},
 		{
 			"echo Hello World!\n",
-			[]Token{newLiteralToken("echo"), newLiteralToken("Hello"), newLiteralToken("World!")},
+			[]Token{newWordToken("echo"), newWordToken("Hello"), newWordToken("World!")},
 		},
 		{
 			"echo    Hello     World!   \n",
-			[]Token{newLiteralToken("echo"), newLiteralToken("Hello"), newLiteralToken("World!")},
+			[]Token{newWordToken("echo"), newWordToken("Hello"), newWordToken("World!")},
 		},
 		{
 			"echo \"Hello World!\"\n",
-			[]Token{newLiteralToken("echo"), newLiteralToken("Hello World!")},
+			[]Token{newWordToken("echo"), newWordToken("Hello World!")},
 		},
 		{
 			"echo \\\"Hello World!\\\"\n",
-			[]Token{newLiteralToken("echo"), newLiteralToken("\"Hello"), newLiteralToken("World!\"")},
+			[]Token{newWordToken("echo"), newWordToken("\"Hello"), newWordToken("World!\"")},
 		},
 		{
 			"echo Hello > output.log\n",
-			[]Token{newLiteralToken("echo"), newLiteralToken("Hello"), newRedirectToken(">", 1), newLiteralToken("output.log")},
+			[]Token{newWordToken("echo"), newWordToken("Hello"), newOperatorToken(">"), newWordToken("output.log")},
 		},
 		{
 			"cat nonexistent 2> error.log\n",
-			[]Token{newLiteralToken("cat"), newLiteralToken("nonexistent"), newRedirectToken(">", 2), newLiteralToken("error.log")},
+			[]Token{newWordToken("cat"), newWordToken("nonexistent"), newIONumberToken(2), newOperatorToken(">"), newWordToken("error.log")},
+		},
+		{
+			"sort < data.txt\n",
+			[]Token{newWordToken("sort"), newOperatorToken("<"), newWordToken("data.txt")},
+		},
+		{
+			"cat 3<in.txt\n",
+			[]Token{newWordToken("cat"), newIONumberToken(3), newOperatorToken("<"), newWordToken("in.txt")},
+		},
+		{
+			"cat <<< \"Hello World!\"\n",
+			[]Token{newWordToken("cat"), newOperatorToken("<<<"), newWordToken("Hello World!")},
+		},
+		{
+			"echo a<b\n",
+			[]Token{newWordToken("echo"), newWordToken("a"), newOperatorToken("<"), newWordToken("b")},
+		},
+		{
+			"cmd > out.log 2>&1\n",
+			[]Token{newWordToken("cmd"), newOperatorToken(">"), newWordToken("out.log"), newIONumberToken(2), newOperatorToken(">&"), newWordToken("1")},
+		},
+		{
+			"cmd 3<&- >&2\n",
+			[]Token{newWordToken("cmd"), newIONumberToken(3), newOperatorToken("<&"), newWordToken("-"), newOperatorToken(">&"), newWordToken("2")},
+		},
+		{
+			"cmd &>out.log &>>all.log\n",
+			[]Token{newWordToken("cmd"), newOperatorToken("&>"), newWordToken("out.log"), newOperatorToken("&>>"), newWordToken("all.log")},
+		},
+		{
+			"make && ./run || echo 'a;b'; ls\n",
+			[]Token{newWordToken("make"), newOperatorToken("&&"), newWordToken("./run"), newOperatorToken("||"),
+				newWordToken("echo"), newWordToken("a;b"), newOperatorToken(";"), newWordToken("ls")},
 		},
 		{
 			"cat file | grep word \n",
-			[]Token{newLiteralToken("cat"), newLiteralToken("file"), newLiteralToken("|"), newLiteralToken("grep"), newLiteralToken("word")},
+			[]Token{newWordToken("cat"), newWordToken("file"), newOperatorToken("|"), newWordToken("grep"), newWordToken("word")},
+		},
+		{
+			"echo '|' \"2\"> # comment\n",
+			[]Token{newWordToken("echo"), newWordToken("|"), newWordToken("2"), newOperatorToken(">")},
 		},
 	}
 
 	for i, tt := range tests {
-		parser := newParser()
-		err := parser.parse(tt.input)
+		tokens, err := lex(tt.input)
 		if err != nil {
 			t.Fatal(err.Error())
 		}
-		testTokens(t, i, parser.tokens, tt.expectedTokens)
+		testTokens(t, i, tokens, tt.expectedTokens)
 	}
 }
 
@@ -61,85 +133,1392 @@ func testTokens(t *testing.T, testId int, tokens []Token, expectedTs []Token) {
 		tok := tokens[i]
 		expT := expectedTs[i]
 
-		if reflect.TypeOf(tok) != reflect.TypeOf(expT) {
-			t.Fatalf("%d: expected token '%s' of type=%T, got '%s' of type %T\n",
-				testId, expT.String(), expT, tok.String(), tok)
+		if tok.kind != expT.kind {
+			t.Fatalf("%d: expected token '%s' of kind=%d, got '%s' of kind %d\n",
+				testId, expT.String(), expT.kind, tok.String(), tok.kind)
+		}
+		if tok.String() != expT.String() {
+			t.Fatalf("%d: Expected token %q, got %q\n", testId, expT.String(), tok.String())
+		}
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	tokens, err := lex("echo a |\n  wc -l\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []Pos{{1, 1}, {1, 6}, {1, 8}, {2, 3}, {2, 6}}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d\n", len(expected), len(tokens))
+	}
+	for i, tok := range tokens {
+		if tok.pos != expected[i] {
+			t.Fatalf("Expected token %q at %s, got %s\n", tok.String(), expected[i], tok.pos)
+		}
+	}
+}
+
+func TestParsePipelines(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedArgs [][]int // number of args of each command of each pipeline
+	}{
+		{"echo hello | grep hello\n", [][]int{{2, 2}}},
+		{"cat foo.bar | wc | grep 0\n", [][]int{{2, 1, 2}}},
+		{"cat foo.bar |\n\n wc\n", [][]int{{2, 1}}},
+		{"echo '|' \"a | b\" \\|\n", [][]int{{4}}},
+		{"echo a && echo b | wc\n", [][]int{{2}, {2, 1}}},
+	}
+
+	for i, tt := range tests {
+		list, err := parse(tt.input)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(list.Items) != 1 {
+			t.Fatalf("%d: expected 1 and-or list in %q, got %d\n", i, tt.input, len(list.Items))
 		}
 
-		switch expTok := expT.(type) {
-		case *LiteralToken:
-			literalTok, ok := tok.(*LiteralToken)
-			if !ok {
-				t.Fatalf("Expected *LiteralToken, got=%T\n", literalTok)
+		pipelines := list.Items[0].Pipelines
+		if len(pipelines) != len(tt.expectedArgs) {
+			t.Fatalf("%d: expected %d pipelines in %q, got %d\n", i, len(tt.expectedArgs), tt.input, len(pipelines))
+		}
+		for j, pipeline := range pipelines {
+			if len(pipeline.Cmds) != len(tt.expectedArgs[j]) {
+				t.Fatalf("%d: expected %d commands in pipeline %d, got %d\n", i, len(tt.expectedArgs[j]), j, len(pipeline.Cmds))
 			}
+			for k, cmd := range pipeline.Cmds {
+				if n := len(cmd.(*SimpleCmd).Args); n != tt.expectedArgs[j][k] {
+					t.Fatalf("%d: expected %d args for command %d, got %d\n", i, tt.expectedArgs[j][k], k, n)
+				}
+			}
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		input       string
+		expectedOps [][]string
+	}{
+		{"cd dir; ls\n", [][]string{nil, nil}},
+		{"make && ./run | tee log || echo failed;\n", [][]string{{"&&", "||"}}},
+		{"a\nb; c &&\nd\n", [][]string{nil, nil, {"&&"}}},
+	}
+
+	for i, tt := range tests {
+		list, err := parse(tt.input)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
 
-			if literalTok.literal != expTok.literal {
-				t.Fatalf("%d: Expected tok.literal=%q, got %q\n", testId, expTok, literalTok)
+		if len(list.Items) != len(tt.expectedOps) {
+			t.Fatalf("%d: expected %d and-or lists in %q, got %d\n", i, len(tt.expectedOps), tt.input, len(list.Items))
+		}
+		for j, andOr := range list.Items {
+			if len(andOr.Ops) != len(tt.expectedOps[j]) {
+				t.Fatalf("%d: expected ops %v in and-or list %d, got %v\n", i, tt.expectedOps[j], j, andOr.Ops)
+			}
+			for k, op := range andOr.Ops {
+				if op != tt.expectedOps[j][k] {
+					t.Fatalf("%d: expected ops %v in and-or list %d, got %v\n", i, tt.expectedOps[j], j, andOr.Ops)
+				}
 			}
+		}
+	}
+}
+
+func TestParseBackground(t *testing.T) {
+	list, err := parse("sleep 1 && echo  done &  ls | wc -l;x=1 &\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []struct {
+		background bool
+		source     string
+	}{
+		{true, "sleep 1 && echo  done"},
+		{false, "ls | wc -l"},
+		{true, "x=1"},
+	}
+	if len(list.Items) != len(expected) {
+		t.Fatalf("expected %d and-or lists, got %d\n", len(expected), len(list.Items))
+	}
+	for i, andOr := range list.Items {
+		if andOr.Background != expected[i].background || andOr.Source != expected[i].source {
+			t.Fatalf("%d: expected %q in the background: %t, got %q: %t\n", i, expected[i].source, expected[i].background, andOr.Source, andOr.Background)
+		}
+	}
+	if source := list.Items[0].Pipelines[1].Source; source != "echo  done" {
+		t.Fatalf("expected the source of the pipeline to be %q, got %q\n", "echo  done", source)
+	}
+}
+
+func TestParsePipelinePrefix(t *testing.T) {
+	list, err := parse("! ls | wc; time -p ls; ! time ! ls; time -p -p\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []struct {
+		negated bool
+		timed   bool
+		posix   bool
+		cmds    int
+	}{
+		{true, false, false, 2},
+		{false, true, true, 1},
+		{false, true, false, 1},
+		{false, true, true, 1},
+	}
+	if len(list.Items) != len(expected) {
+		t.Fatalf("expected %d and-or lists, got %d\n", len(expected), len(list.Items))
+	}
+	for i, andOr := range list.Items {
+		p := andOr.Pipelines[0]
+		if p.Negated != expected[i].negated || p.Timed != expected[i].timed || p.Posix != expected[i].posix || len(p.Cmds) != expected[i].cmds {
+			t.Fatalf("%d: expected %+v, got negated: %t, timed: %t, posix: %t, %d commands\n", i, expected[i], p.Negated, p.Timed, p.Posix, len(p.Cmds))
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input       string
+		expectedErr error
+	}{
+		{"; ls\n", nil},
+		{"ls && && ls\n", nil},
+		{"ls ;; ls\n", nil},
+		{"| ls\n", nil},
+		{"ls >\n", nil},
+		{"ls |\n", PipeHasNoTargetErr},
+		{"ls &&\n", PipeHasNoTargetErr},
+		{"echo \"a\n", UnclosedQuoteErr},
+		{"echo 'a\n", UnclosedQuoteErr},
+		{"cat <<EOF\na\n", HeredocPendingErr},
+		{"cat <<EOF\n${x\nEOF\n", nil},
+		{"cat <<EOF\n$(echo hi\nEOF\n", nil},
+		{"echo ${a\n", UnclosedQuoteErr},
+		{"echo ${a b}\n", nil},
+		{"echo ${#a:-b}\n", nil},
+		{"echo ${a[]}\n", nil},
+		{"echo ${a[1}\n", nil},
+		{"echo ${a[1]b}\n", nil},
+		{"echo $(echo a\n", UnclosedQuoteErr},
+		{"echo `echo a\n", UnclosedQuoteErr},
+		{"echo $(;)\n", nil},
+		{"echo $((1 + (2\n", UnclosedQuoteErr},
+		{"((1 + 2\n", UnclosedQuoteErr},
+		{"( ls\n", CompoundPendingErr},
+		{"((cd dir; ls) | wc\n", CompoundPendingErr},
+		{"{ ls\n", CompoundPendingErr},
+		{"( )\n", nil},
+		{"( ls ) wc\n", nil},
+		{"{ ls }\n", CompoundPendingErr},
+		{"{ ls; } }\n", nil},
+		{"ls )\n", nil},
+		{"if true; then\n", CompoundPendingErr},
+		{"if true\nthen echo a\nelse\n", CompoundPendingErr},
+		{"if cat <<EOF; then\n", HeredocPendingErr},
+		{"if; then echo a; fi\n", nil},
+		{"if true; then fi\n", nil},
+		{"if true; fi\n", nil},
+		{"then echo a\n", nil},
+		{"if true; then echo a; fi b\n", nil},
+		{"echo a | fi\n", nil},
+		{"while let 1\n", CompoundPendingErr},
+		{"until let 1; do\n", CompoundPendingErr},
+		{"for i in a b\n", CompoundPendingErr},
+		{"for i\n\n", CompoundPendingErr},
+		{"for ((i = 0; i < 3; i++))\n", CompoundPendingErr},
+		{"while let 1; done\n", nil},
+		{"for 1 in a; do echo; done\n", nil},
+		{"for i in a | b; do echo; done\n", nil},
+		{"for ((i = 0; i < 3)); do echo; done\n", nil},
+		{"do echo a; done\n", nil},
+		{"case $x in\n", CompoundPendingErr},
+		{"case $x in a) echo a;;\n", CompoundPendingErr},
+		{"case $x in a|\n", nil},
+		{"case $x\n", CompoundPendingErr},
+		{"case $x on a) echo a;; esac\n", nil},
+		{"case $x in a b) echo a;; esac\n", nil},
+		{"case $x in a) echo a; fi\n", nil},
+		{"esac\n", nil},
+		{"f() {\n", CompoundPendingErr},
+		{"f()\n", CompoundPendingErr},
+		{"function f\n", CompoundPendingErr},
+		{"f() { echo a\n", CompoundPendingErr},
+		{"f() echo a\n", nil},
+		{"f( ) {}\n", nil},
+		{"\"f\"() { echo a; }\n", nil},
+		{"echo a() { echo a; }\n", nil},
+		{"function { echo a; }\n", nil},
+		{"}\n", nil},
+	}
+
+	for i, tt := range tests {
+		_, err := parse(tt.input)
+		if err == nil {
+			t.Fatalf("%d: expected an error for %q\n", i, tt.input)
+		}
+		if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+			t.Fatalf("%d: expected %v for %q, got %v\n", i, tt.expectedErr, tt.input, err)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		input       string
+		expectedErr string
+	}{
+		{"ls ;; ls\n", "1:4: Unexpected token `;;`"},
+		{"echo a |\n  wc )\n", "2:6: Unexpected token `)`"},
+		{"if true; then echo a; fi b\n", "1:26: Unexpected token `b`"},
+		{"ls >\n", "1:5: Unexpected token `newline`"},
+		{"for ((i = 0; i < 3)); do echo; done\n", "1:5: Unexpected token `((i = 0; i < 3))`"},
+		{"echo $(ls ;; )\n", "1:11: Unexpected token `;;`"},
+		{"cat <<EOF\ncost ${x\nEOF\n", "1:5: Unexpected token `EOF`"},
+		{"cat <<EOF\n$(echo hi\nEOF\n", "1:5: Unexpected token `EOF`"},
+		{"echo a; cat <<EOF >out\n`ls\nEOF\n", "1:13: Unexpected token `EOF`"},
+		{"cat <<EOF\nok\n$(if true)\nEOF\n", "3:10: Unexpected token `)`"},
+		{"!\n", "1:2: Unexpected token `newline`"},
+		{"time | cat\n", "1:6: Unexpected token `|`"},
+	}
+
+	for i, tt := range tests {
+		_, err := parse(tt.input)
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Fatalf("%d: expected %q for %q, got %v\n", i, tt.expectedErr, tt.input, err)
+		}
+	}
+}
+
+func parseSimpleCmd(t *testing.T, input string) *SimpleCmd {
+	list, err := parse(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return list.Items[0].Pipelines[0].Cmds[0].(*SimpleCmd)
+}
+
+func TestFdTableAppliesRedirectsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	out := dir + "/out.log"
+
+	tests := []struct {
+		input          string
+		expectedStdout string
+		expectedStderr string
+	}{
+		{"cmd >" + out + " 2>&1\n", out, out},
+		{"cmd 2>&1 >|" + out + "\n", out, "stdout"},
+		{"cmd 2>&1 1>&-\n", "", "stdout"},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+
+		fds := newFdTable("", os.Stdin, os.Stdout, os.Stderr)
+		if err := fds.applyAll(cmd.redirects); err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
 
-		case *RedirectToken:
-			redirectTok, ok := tok.(*RedirectToken)
-			if !ok {
-				t.Fatalf("Expected *RedirectToken, got=%T\n", redirectTok)
+		for fd, expected := range map[int]string{STDOUT: tt.expectedStdout, STDERR: tt.expectedStderr} {
+			name := ""
+			if file, ok := fds.fds[fd].(*os.File); ok {
+				name = file.Name()
+			}
+			if expected == "stdout" {
+				expected = os.Stdout.Name()
 			}
+			if name != expected {
+				t.Fatalf("%d: expected fd %d to be %q, got %q\n", i, fd, expected, name)
+			}
+		}
+		fds.close()
+	}
+}
+
+func TestReadWriteRedirect(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		input          string
+		expectedOutput string
+	}{
+		{"echo hello >" + dir + "/rw; cat <>" + dir + "/rw\n", "hello\n"},
+		{"echo J 1<>" + dir + "/rw; cat " + dir + "/rw\n", "J\nllo\n"},
+		{"cat <>" + dir + "/new; cat " + dir + "/new && echo created\n", "created\n"},
+		{"echo x 3<>" + dir + "/fd3 >&3; cat " + dir + "/fd3\n", "x\n"},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		if output := runScript(t, shell, tt.input); output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+	}
+}
 
-			if expTok.op != redirectTok.op {
-				t.Fatalf("%d: Expected tok.op=%q, got %q\n", testId, expTok.op, redirectTok.op)
+func TestHeredoc(t *testing.T) {
+	tests := []struct {
+		lines        []string
+		expectedBody string
+	}{
+		{[]string{"cat <<EOF\n", "hello\n", "  world\n", "EOF\n"}, "hello\n  world\n"},
+		{[]string{"cat <<-EOF\n", "\thello\n", "\t\tworld\n", "\tEOF\n"}, "hello\nworld\n"},
+		{[]string{"cat << 'EOF'\n", "a \\$b $? \\\\\n", "EOF\n"}, "a \\$b $? \\\\\n"},
+		{[]string{"cat <<E\"O\"F\n", "x\\\n", "EOF\n"}, "x\\\n"},
+		{[]string{"cat <<EOF\n", "a \\$b $? \\\\ \\\n", "c\n", "EOF\n"}, "a $b 0 \\ c\n"},
+		{[]string{"cat <<EOF | wc\n", "\n", "EOF\n"}, "\n"},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		input := ""
+		var list *List
+		var err error
+		for j, line := range tt.lines {
+			input += line
+			list, err = parse(input)
+			if j < len(tt.lines)-1 && !errors.Is(err, HeredocPendingErr) {
+				t.Fatalf("%d: expected pending here-document after %q, got %v\n", i, line, err)
 			}
+		}
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+
+		cmd, err := shell.expandSimpleCmd(list.Items[0].Pipelines[0].Cmds[0].(*SimpleCmd))
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		if len(cmd.redirects) != 1 {
+			t.Fatalf("%d: expected 1 redirection, got %d\n", i, len(cmd.redirects))
+		}
+		if cmd.redirects[0].target != tt.expectedBody {
+			t.Fatalf("%d: expected body %q, got %q\n", i, tt.expectedBody, cmd.redirects[0].target)
+		}
+	}
+}
 
-			if expTok.fd != redirectTok.fd {
-				t.Fatalf("%d: Expected tok.fd=%d, got %d\n", testId, expTok.fd, redirectTok.fd)
+func TestExpandWord(t *testing.T) {
+	t.Setenv("X", "a  b")
+	t.Setenv("EMPTY", "")
+	t.Setenv("P", "dir/sub/file.tar.gz")
+	os.Unsetenv("UNSET")
+
+	tests := []struct {
+		input        string
+		expectedArgs []string
+	}{
+		{"echo $? \"[$?]\" '$?' \\$?\n", []string{"echo", "42", "[42]", "$?", "$?"}},
+		{"echo a\"b\"'c'\\d \"\\\"\\a\"\n", []string{"echo", "abcd", "\"\\a"}},
+		{"echo $X \"$X\" ${X}c $UNSET \"$UNSET\" $\n", []string{"echo", "a", "b", "a  b", "a", "bc", "", "$"}},
+		{"echo ${UNSET:-x y} \"${UNSET:-x y}\" ${EMPTY-x} ${EMPTY:-'a  b'}\n", []string{"echo", "x", "y", "x y", "a  b"}},
+		{"echo ${X:+set} ${UNSET:+set} ${#X} ${#UNSET}\n", []string{"echo", "set", "4", "0"}},
+		{"echo ${P#*/} ${P##*/} ${P%.*} ${P%%.*} ${P#\"*\"}\n", []string{"echo", "sub/file.tar.gz", "file.tar.gz", "dir/sub/file.tar", "dir/sub/file", "dir/sub/file.tar.gz"}},
+		{"echo \"${P##*/}\" ${P#[a-d]??/}\n", []string{"echo", "file.tar.gz", "sub/file.tar.gz"}},
+		{"echo ${NEW:=new} $NEW\n", []string{"echo", "new", "new"}},
+		{"echo $(echo a  b) \"$(echo a  b)\" x$(echo)y\n", []string{"echo", "a", "b", "a b", "xy"}},
+		{"echo \"$(echo \"$(echo in; echo)\")\" `echo \\`echo bq\\``\n", []string{"echo", "in", "bq"}},
+		{"echo ${UNSET:-$(echo default)} $(cd /; exit 3; echo no)$?\n", []string{"echo", "default", "3"}},
+	}
+
+	cwd, _ := os.Getwd()
+	shell := NewShell(context.Background())
+	shell.status = 42
+	for i, tt := range tests {
+		cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		if len(cmd.argv) != len(tt.expectedArgs) {
+			t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
+		}
+		for j := range cmd.argv {
+			if cmd.argv[j] != tt.expectedArgs[j] {
+				t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
 			}
-		default:
-			t.Fatalf("unexpected type: %q\n", expTok)
+		}
+	}
+
+	if dir, _ := os.Getwd(); dir != cwd {
+		t.Fatalf("expected command substitutions to keep the working directory %q, got %q\n", cwd, dir)
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	os.Unsetenv("UNSET")
+
+	tests := []struct {
+		input       string
+		expectedErr string
+	}{
+		{"echo ${UNSET:?is required}\n", "UNSET: is required"},
+		{"echo ${UNSET?}\n", "UNSET: parameter null or not set"},
+		{"echo hi > $UNSET\n", "$UNSET: ambiguous redirect"},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		_, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
+		if err == nil || err.Error() != tt.expectedErr {
+			t.Fatalf("%d: expected error %q, got %v\n", i, tt.expectedErr, err)
 		}
 	}
 }
 
-func TestSplitAtPipe(t *testing.T) {
+func TestAssignments(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("X", "a  b")
+
 	tests := []struct {
 		input           string
-		expectedTokSets [][]Token
+		expectedAssigns []assignment
+		expectedArgs    []string
 	}{
-		{
-			"echo hello | grep hello\n",
-			[][]Token{
-				{newLiteralToken("echo"), newLiteralToken("hello")},
-				{newLiteralToken("grep"), newLiteralToken("hello")},
-			},
-		},
-		{
-			"cat foo.bar | wc | grep 0\n",
-			[][]Token{
-				{newLiteralToken("cat"), newLiteralToken("foo.bar")},
-				{newLiteralToken("wc")},
-				{newLiteralToken("grep"), newLiteralToken("0")},
-			},
-		},
+		{"A=1\n", []assignment{{"A", "1"}}, nil},
+		{"A=$X B=~/x:~/y C= env A=2\n", []assignment{{"A", "a  b"}, {"B", "/home/me/x:/home/me/y"}, {"C", ""}}, []string{"env", "A=2"}},
+		{"A=\"q\"$X'*' =x 1A=y\n", []assignment{{"A", "qa  b*"}}, []string{"=x", "1A=y"}},
+		{"\"A\"=1 A\\=1\n", nil, []string{"A=1", "A=1"}},
+		{"export A=$X B=~ \"C=$X\" $X\n", nil, []string{"export", "A=a  b", "B=/home/me", "C=a  b", "a", "b"}},
 	}
 
+	shell := NewShell(context.Background())
 	for i, tt := range tests {
-		parser := newParser()
-		err := parser.parse(tt.input)
+		cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
 		if err != nil {
-			t.Fatal(err.Error())
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		if len(cmd.assigns) != len(tt.expectedAssigns) {
+			t.Fatalf("%d: expected assignments %q, got %q\n", i, tt.expectedAssigns, cmd.assigns)
+		}
+		for j := range cmd.assigns {
+			if cmd.assigns[j] != tt.expectedAssigns[j] {
+				t.Fatalf("%d: expected assignments %q, got %q\n", i, tt.expectedAssigns, cmd.assigns)
+			}
+		}
+		if len(cmd.argv) != len(tt.expectedArgs) {
+			t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
+		}
+		for j := range cmd.argv {
+			if cmd.argv[j] != tt.expectedArgs[j] {
+				t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
+			}
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	t.Setenv("EXPORTED", "e")
+
+	shell := NewShell(context.Background())
+	shell.stdout = &strings.Builder{}
+	run := func(argv ...string) int {
+		status, err := shell.runBuiltin(argv)
+		if err != nil {
+			t.Fatalf("%q: %s\n", argv, err.Error())
+		}
+		return status
+	}
+	environ := func(assigns ...assignment) []string {
+		var env []string
+		for _, kv := range shell.environ(assigns) {
+			if strings.HasPrefix(kv, "EXPORTED=") || strings.HasPrefix(kv, "V") {
+				env = append(env, kv)
+			}
+		}
+		return env
+	}
+	expectEnviron := func(expected []string, assigns ...assignment) {
+		t.Helper()
+		env := environ(assigns...)
+		if strings.Join(env, " ") != strings.Join(expected, " ") {
+			t.Fatalf("expected environment %q, got %q\n", expected, env)
+		}
+	}
+
+	if err := shell.assign([]assignment{{"V1", "1"}, {"V2", "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectEnviron([]string{"EXPORTED=e"})
+	expectEnviron([]string{"EXPORTED=x", "V3=3"}, assignment{"V3", "3"}, assignment{"EXPORTED", "x"})
+
+	if status := run(EXPORT, "V1", "V4=4", "1V"); status != 1 {
+		t.Fatalf("expected export of an invalid name to fail, got status %d\n", status)
+	}
+	expectEnviron([]string{"EXPORTED=e", "V1=1", "V4=4"})
+
+	run(EXPORT, "-n", "EXPORTED")
+	run(UNSET, "V4", "V5")
+	expectEnviron([]string{"V1=1"})
+	if value, ok := shell.lookupVar("EXPORTED"); !ok || value != "e" {
+		t.Fatalf("expected EXPORTED to stay set to \"e\", got %q\n", value)
+	}
+
+	status, err := shell.withAssigns([]assignment{{"V1", "tmp"}, {"V6", "6"}}, func() (int, error) {
+		expectEnviron([]string{"V1=tmp"})
+		if value, _ := shell.lookupVar("V6"); value != "6" {
+			t.Fatalf("expected V6 to be set to \"6\", got %q\n", value)
+		}
+		return 3, nil
+	})
+	if status != 3 || err != nil {
+		t.Fatalf("expected status 3, got %d and %v\n", status, err)
+	}
+	expectEnviron([]string{"V1=1"})
+	if _, ok := shell.vars["V6"]; ok {
+		t.Fatalf("expected V6 to be unset again\n")
+	}
+
+	run(READONLY, "V2", "V7=7")
+	for _, name := range []string{"V2", "V7"} {
+		err := shell.setVar(name, "x")
+		if err == nil || err.Error() != name+": readonly variable" {
+			t.Fatalf("expected %s to be readonly, got %v\n", name, err)
+		}
+		if status := run(UNSET, name); status != 1 {
+			t.Fatalf("expected unset of readonly %s to fail, got status %d\n", name, status)
+		}
+	}
+	if _, err := shell.withAssigns([]assignment{{"V2", "x"}}, nil); err == nil {
+		t.Fatalf("expected an assignment to a readonly variable to fail\n")
+	}
+
+	out := &strings.Builder{}
+	shell.stdout = out
+	run(READONLY)
+	if expected := "declare -r V2=\"2\"\ndeclare -r V7=\"7\"\n"; out.String() != expected {
+		t.Fatalf("expected readonly to print %q, got %q\n", expected, out.String())
+	}
+}
+
+// runScript runs input with the output of the shell captured, which works
+// as long as only builtins write to it.
+func runScript(t *testing.T, shell *Shell, input string) string {
+	t.Helper()
+	list, err := parse(input)
+	if err != nil {
+		t.Fatalf("%q: %s\n", input, err.Error())
+	}
+	out := &strings.Builder{}
+	shell.stdout = out
+	if err := shell.execute(list); err != nil {
+		t.Fatalf("%q: %s\n", input, err.Error())
+	}
+	return out.String()
+}
+
+func TestIf(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"if let 1; then echo a; echo b; fi\n", "a\nb\n", 0},
+		{"if let 0; then echo a; fi\n", "", 0},
+		{"if let 0; then echo a; else echo b; let 0; fi\n", "b\n", 1},
+		{"if let 0; then echo a\nelif let 0; then echo b\nelif let 1\nthen echo c\nelse echo d\nfi\n", "c\n", 0},
+		{"if let 0; let 1; then echo last; fi\n", "last\n", 0},
+		{"if if let 1; then let 0; fi; then echo a; else echo nested; fi\n", "nested\n", 0},
+		{"x=2; if ((x > 1)); then echo then fi; fi && echo and\n", "then fi\nand\n", 0},
+		{"if let 1; then echo out; fi >" + dir + "/out; echo done\n", "done\n", 0},
+		{"if let 1; then echo in; fi >>" + dir + "/out 2>&1\n", "", 0},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+
+	if content, _ := os.ReadFile(dir + "/out"); string(content) != "out\nin\n" {
+		t.Fatalf("expected the redirection of the if clause to get \"out\\nin\\n\", got %q\n", content)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"for i in a{1..2} \"b  c\"; do echo \"$i\"; done\n", "a1\na2\nb  c\n", 0},
+		{"for i in; do echo $i; done\n", "", 0},
+		{"for i\ndo echo $i; done\n", "", 0},
+		{"for ((i = 0; i < 3; i++)); do echo $i; done; echo $i\n", "0\n1\n2\n3\n", 0},
+		{"for ((;;)) do echo once; break; done\n", "once\n", 0},
+		{"i=0; while ((i < 3)); do let i++; echo $i; done\n", "1\n2\n3\n", 0},
+		{"i=0; until ((i == 2)); do let i++; done; echo $i\n", "2\n", 0},
+		{"while let 0; do echo never; done\n", "", 0},
+		{"for i in 1 2 3; do if ((i == 2)); then continue; fi; echo $i; let 0; done\n", "1\n3\n", 1},
+		{"for i in 1 2 3; do echo $i; break; echo no; done\n", "1\n", 0},
+		{"for i in 1 2; do for j in a b c; do ((${#j} == 1)) && continue 2; echo no; done; echo no; done; echo $i$j\n", "2a\n", 0},
+		{"for i in 1 2; do while let 1; do break 2; done; echo no; done; echo $i\n", "1\n", 0},
+		{"for i in 1 2; do while let 1; do break 9; done; done; echo $i\n", "1\n", 0},
+		{"i=0; while let i++ \"i < 3\"; do echo $i; done\n", "1\n2\n", 0},
+		{"i=0; while break; do echo no; done\n", "", 0},
+		{"break; echo after\n", "after\n", 0},
+		{"for i in 1; do break 0; done\n", "", 1},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+		if shell.loops != 0 || shell.unwinding() {
+			t.Fatalf("%d: expected no loop left running\n", i)
 		}
+	}
+
+	if output := runScript(t, shell, "set -- x \"y z\"; for arg; do echo $arg $#; done\n"); output != "x 2\ny z 2\n" {
+		t.Fatalf("expected a loop over the positional parameters, got %q\n", output)
+	}
+	if output := runScript(t, shell, "set --; for arg; do echo $arg; done; echo $#\n"); output != "0\n" {
+		t.Fatalf("expected no positional parameters left to loop over, got %q\n", output)
+	}
+}
+
+func TestLoopInterrupt(t *testing.T) {
+	shell := NewShell(context.Background())
+	shell.sigint = make(chan os.Signal, 1)
+	shell.sigint <- os.Interrupt
+
+	output := runScript(t, shell, "while let 1; do echo loop; done; echo after\n")
+	if output != "" || !shell.interrupted() {
+		t.Fatalf("expected the loop and the rest of the list to be interrupted, got %q and status %d\n", output, shell.status)
+	}
+}
+
+func TestCase(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("STAR", "*")
+
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"case stop in start|stop) echo svc;; *) echo other;; esac\n", "svc\n", 0},
+		{"case reload in start|stop) echo svc;; *) echo other;; esac\n", "other\n", 0},
+		{"case x in y) echo y;; esac\n", "", 0},
+		{"case x in (x) let 0;; esac\n", "", 1},
+		{"case x in x) ;; esac\n", "", 0},
+		{"case x in\n  x)\n    echo a\n    ;;\n  y) echo b\nesac\n", "a\n", 0},
+		{"case file.go in *.[ch]) echo c;; *.go) echo go; esac\n", "go\n", 0},
+		{"case abc in a*) echo a;& z) echo z;;& *c) echo c;; *) echo no;; esac\n", "a\nz\nc\n", 0},
+		{"case x in x) echo x;;& y) echo y;;& *) echo any;; esac\n", "x\nany\n", 0},
+		{"case '*' in \"$STAR\") echo quoted;; esac; case x in \"$STAR\") echo no;; $STAR) echo unquoted;; esac\n", "quoted\nunquoted\n", 0},
+		{"case /home/me in ~) echo home;; esac\n", "home\n", 0},
+		{"case esac in (esac) echo esac;; esac\n", "esac\n", 0},
+		{"for w in a b c; do case $w in b) continue;; c) break;; esac; echo $w; done\n", "a\n", 0},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"greet() { echo \"hi $1\" $#; }; greet you there\n", "hi you 2\n", 0},
+		{"function f { echo f; }; function g() { echo g; }; f; g\n", "f\ng\n", 0},
+		{"f()\n{\n  echo multi\n}\nf\n", "multi\n", 0},
+		{"f() { let 0; }; f\n", "", 1},
+		{"f() { return 3; echo no; }; f; echo $?\n", "3\n", 0},
+		{"f() { let 0; return; }; f\n", "", 1},
+		{"f() { for i in 1 2; do while let 1; do return 5; done; done; echo no; }; f\n", "", 5},
+		{"f() if let 1; then echo if body; fi; f\n", "if body\n", 0},
+		{"args() { for a in \"$@\"; do echo \"[$a]\"; done; echo \"$*\" $@; }; args 'a  b' c\n", "[a  b]\n[c]\na  b c a b c\n", 0},
+		{"args() { for a in x\"$@\"y; do echo \"[$a]\"; done; for a in \"$@\"; do echo no; done; }; args\n", "[xy]\n", 0},
+		{"f() { echo $1; g two; echo $1; }; g() { echo $1; }; f one\n", "one\ntwo\none\n", 0},
+		{"x=global; f() { local x=local y; y=set; g; }; g() { echo $x $y; }; f; echo $x \"[$y]\"\n", "local set\nglobal []\n", 0},
+		{"f() { local x=1; x=2; echo $x; }; x=0; f; echo $x\n", "2\n0\n", 0},
+		{"f() { z=leak; }; f; echo $z\n", "leak\n", 0},
+		{"f() { echo out; } >" + dir + "/out; f; echo done\n", "done\n", 0},
+		{"f() { echo call; }; f >>" + dir + "/out\n", "", 0},
+		{"echo() { let 0; }; echo no; unset -f echo; echo unset\n", "unset\n", 0},
+		{"f() { echo f; }; unset f; f 2>/dev/null; echo $?\n", "127\n", 0},
+		{"local x\n", "", 1},
+		{"return\n", "", 1},
+		{"f() { f; }; f 2>/dev/null\n", "", 1},
+		{"for i in 1 2 3; do f() { echo $i; }; done; f\n", "3\n", 0},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+		if len(shell.locals) != 0 || shell.unwinding() || len(shell.args) != 0 {
+			t.Fatalf("%d: expected no function left running\n", i)
+		}
+	}
+
+	if content, _ := os.ReadFile(dir + "/out"); string(content) != "out\ncall\n" {
+		t.Fatalf("expected the redirections of the function to get \"out\\ncall\\n\", got %q\n", content)
+	}
+}
+
+func TestGrouping(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"x=1; (x=2; echo $x); echo $x\n", "2\n1\n", 0},
+		{"x=1; { x=2; echo $x; }; echo $x\n", "2\n2\n", 0},
+		{"(exit 3); echo $?\n", "3\n", 0},
+		{"{ let 0; }\n", "", 1},
+		{"(f() { echo f; }); f 2>/dev/null; echo $?\n", "127\n", 0},
+		{"f() { local x=in; (x=sub); echo $x; }; f\n", "in\n", 0},
+		{"for i in 1 2; do (break); echo $i; done\n", "1\n2\n", 0},
+		{"((echo nested) )\n", "nested\n", 0},
+		{"(\necho multi\n)\n", "multi\n", 0},
+		{"{ echo a; echo b; } >" + dir + "/out; (echo c) >>" + dir + "/out\n", "", 0},
+		{"{ echo a; echo b; } | cat\n", "a\nb\n", 0},
+		{"for i in 1 2; do echo $i; done | (cat; exit 4)\n", "1\n2\n", 4},
+		{"echo in | { cat; echo end; } | cat\n", "in\nend\n", 0},
+		{"{ while let 1; do echo y; done; } | head -n 2\n", "y\ny\n", 0},
+		{"x=1; echo | { x=2; }; echo $x\n", "1\n", 0},
+	}
+
+	cwd, _ := os.Getwd()
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+
+	if content, _ := os.ReadFile(dir + "/out"); string(content) != "a\nb\nc\n" {
+		t.Fatalf("expected the redirections of the groups to get \"a\\nb\\nc\\n\", got %q\n", content)
+	}
+
+	runScript(t, shell, "(cd "+dir+"); echo | { cd "+dir+"; }\n")
+	if shell.dir != cwd {
+		t.Fatalf("expected subshells to keep the working directory %q, got %q\n", cwd, shell.dir)
+	}
+	runScript(t, shell, "{ cd "+dir+"; }\n")
+	if shell.dir != dir {
+		t.Fatalf("expected a brace group to change the working directory to %q, got %q\n", dir, shell.dir)
+	}
+	if wd, _ := os.Getwd(); wd != cwd {
+		t.Fatalf("expected the working directory of the process to stay %q, got %q\n", cwd, wd)
+	}
+}
+
+func TestSubshellDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	cwd, _ := os.Getwd()
+
+	tests := []struct {
+		input          string
+		expectedOutput string
+	}{
+		// the second stage runs while the first one is in another directory
+		{"(cd /; sleep 0.5) | (sleep 0.2; pwd; /bin/pwd)\n", cwd + "\n" + cwd + "\n"},
+		{"(cd " + dir + "; sleep 0.5) | (sleep 0.2; echo $(pwd))\n", cwd + "\n"},
+		{"(cd " + dir + "; pwd; /bin/pwd); pwd\n", dir + "\n" + dir + "\n" + cwd + "\n"},
+		{"cd " + dir + "; echo x >out; cat out; cat <out; echo *; cd sub; pwd; cd ..; ls\n", "x\nx\nout sub\n" + dir + "/sub\nout\nsub\n"},
+		{"{ cat <missing; } 2>&1\n", "open missing: no such file or directory\n"},
+		{"cd " + cwd + "; echo $(cd " + dir + "; pwd) $(pwd)\n", dir + " " + cwd + "\n"},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		if output := runScript(t, shell, tt.input); output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+	}
+}
+
+func TestBuiltinStages(t *testing.T) {
+	dir := t.TempDir()
+	cwd, _ := os.Getwd()
+
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"echo hi | tr a-z A-Z\n", "HI\n", 0},
+		{"echo a | cat | echo b\n", "b\n", 0},
+		{"f() { echo fn $1; }; f x | cat\n", "fn x\n", 0},
+		{"f() { cat; }; echo in | f | tr a-z A-Z\n", "IN\n", 0},
+		{"shopt -p nullglob | cat\n", "shopt -u nullglob\n", 0},
+		{"echo a | let 0\n", "", 1},
+		{"echo a | exit 4; echo $?\n", "4\n", 0},
+		{"exit 3 | cat; echo $?\n", "0\n", 0},
+		{"x=1 | cat; echo ${x-unset}\n", "unset\n", 0},
+		{">" + dir + "/empty | echo next\n", "next\n", 0},
+		{"type echo >" + dir + "/type; cat " + dir + "/type\n", "echo is a shell builtin\n", 0},
+		{"echo err >&2 2>/dev/null | cat\n", "", 0},
+		{"echo closed >&- 2>/dev/null\n", "", 1},
+		{"cd " + dir + "/missing 2>/dev/null || echo failed\n", "failed\n", 0},
+		{"{ echo group; type cat >/dev/null; } 2>&1 | cat\n", "group\n", 0},
+		{"cd " + dir + " | pwd\n", cwd + "\n", 0},
+		{"{ cd /; sleep 0.5; } | { sleep 0.2; pwd; /bin/pwd; echo $(pwd); }\n", cwd + "\n" + cwd + "\n" + cwd + "\n", 0},
+		{"f() { cd $1; sleep 0.5; }; f / | { sleep 0.2; pwd; }; pwd\n", cwd + "\n" + cwd + "\n", 0},
+		{"f() { cd $1; pwd; }; f " + dir + " | cat; pwd\n", dir + "\n" + cwd + "\n", 0},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+
+	if _, err := os.Stat(dir + "/empty"); err != nil {
+		t.Fatalf("expected a command without a name to create its file: %s\n", err.Error())
+	}
+}
+
+func TestPipes(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"seq 3 | cat | cat | cat\n", "1\n2\n3\n", 0},
+		{"cat </dev/null | let 0\n", "", 1},
+		{"yes | head -n 1\n", "y\n", 0},
+		{"yes | head -c 1000000 | wc -c\n", "1000000\n", 0},
+		{"yes | { head -n 1; }\n", "y\n", 0},
+		{"yes | (read_one() { head -n 1; }; read_one)\n", "y\n", 0},
+		{"{ sleep 0.1; echo late; } | echo first\n", "first\n", 0},
+		{"{ while let 1; do echo y; done; echo after; } | head -n 1\n", "y\n", 0},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+}
+
+func TestPipeStatus(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"(exit 2) | (exit 3) | let 1; echo ${PIPESTATUS[@]}\n", "2 3 0\n", 0},
+		{"(exit 2) | let 1; echo $PIPESTATUS ${PIPESTATUS[1]} ${PIPESTATUS[-1]} ${#PIPESTATUS[*]}\n", "2 0 0 2\n", 0},
+		{"i=0; (exit 2) | let 1; echo ${PIPESTATUS[i]} ${PIPESTATUS[$i+1]} ${PIPESTATUS[2]-unset}\n", "2 0 unset\n", 0},
+		{"(exit 1) | (exit 2); for s in \"${PIPESTATUS[@]}\"; do echo s$s; done\n", "s1\ns2\n", 0},
+		{"yes | head -n 1 >/dev/null; echo ${PIPESTATUS[@]}\n", "141 0\n", 0},
+		{"let 0; echo ${PIPESTATUS[@]}\n", "1\n", 0},
+		{"{ (exit 4) | let 1; }; echo ${PIPESTATUS[@]}\n", "4 0\n", 0},
+		{"(exit 2) | (exit 3) | let 1\n", "", 0},
+		{"set -o pipefail; (exit 2) | (exit 3) | let 1\n", "", 3},
+		{"(exit 2) | let 1 | let 1\n", "", 2},
+		{"let 1 | let 1\n", "", 0},
+		{"set +o pipefail; (exit 2) | let 1\n", "", 0},
+		{"set -o | cat\n", "pipefail       \toff\n", 0},
+		{"set -o pipefail; set +o; set +o pipefail\n", "set -o pipefail\n", 0},
+		{"set -o nope 2>/dev/null\n", "", 1},
+		{"set -e 2>/dev/null\n", "", 2},
+		{"set -o pipefail -- a \"b c\"; echo $# $2; set +o pipefail\n", "2 b c\n", 0},
+		{"echo ${PIPESTATUS[1]=x} 2>/dev/null\n", "", 1},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+}
+
+func TestPipelinePrefix(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"! let 1\n", "", 1},
+		{"! let 0\n", "", 0},
+		{"! ! let 0\n", "", 1},
+		{"! let 1 | let 0\n", "", 0},
+		{"if ! let 0; then echo y; fi\n", "y\n", 0},
+		{"! let 0 && echo and || echo or\n", "and\n", 0},
+		{"! (exit 3) | let 1; echo $? ${PIPESTATUS[@]}\n", "1 3 0\n", 0},
+		{"TIMEFORMAT=; time let 0\n", "", 1},
+		{"time ! let 0\n", "", 0},
+		{"TIMEFORMAT='t %%'; { time let 1; } 2>&1\n", "t %\n", 0},
+		{"unset TIMEFORMAT; { time -p echo out | cat; } 2>&1 | grep -c '^real 0.[0-9][0-9]$'\n", "1\n", 0},
+		{"unset TIMEFORMAT; { time let 1; } 2>&1 | cut -c 1-7\n", "\nreal\t0m\nuser\t0m\nsys\t0m0\n", 0},
+		{"TIMEFORMAT=x; { time; } 2>&1\n", "x\n", 0},
+		{"(TIMEFORMAT=y; time -p\n) 2>&1\n", "real 0.00\nuser 0.00\nsys 0.00\n", 0},
+		{"TIMEFORMAT=z; { time && echo and; } 2>&1\n", "z\nand\n", 0},
+		{"type time !\n", "time is a shell keyword\n! is a shell keyword\n", 0},
+		{"echo time !\n", "time !\n", 0},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+	}
+}
+
+func TestCPUUsage(t *testing.T) {
+	var outer cpuUsage
+	inner := cpuUsage{parent: &outer}
+	inner.add(time.Second, 2*time.Second)
+	outer.add(3*time.Second, 4*time.Second)
+
+	if user, sys := inner.times(); user != time.Second || sys != 2*time.Second {
+		t.Fatalf("expected the inner pipeline to take 1s and 2s, got %s and %s\n", user, sys)
+	}
+	if user, sys := outer.times(); user != 4*time.Second || sys != 6*time.Second {
+		t.Fatalf("expected the outer pipeline to take 4s and 6s, got %s and %s\n", user, sys)
+	}
+
+	// outside of timed pipelines, nothing is counted
+	var none *cpuUsage
+	none.add(time.Second, time.Second)
+}
+
+func TestFormatTimes(t *testing.T) {
+	real, user, sys := 62345*time.Millisecond, 1500*time.Millisecond, 999*time.Millisecond
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"%R %U %S", "62.345 1.500 0.999"},
+		{"%lR %1lU %0S", "1m2.345s 0m1.5s 0"},
+		{"%2R %9U", "62.34 1.500"},
+		{"%P", "4.01"},
+		{"100%% %x %", "100% %x %"},
+		{"%3", "%3"},
+		{"a\tb", "a\tb"},
+	}
+	for _, tt := range tests {
+		if s := formatTimes(tt.format, real, user, sys); s != tt.expected {
+			t.Fatalf("%q: expected %q, got %q\n", tt.format, tt.expected, s)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	cwd, _ := os.Getwd()
+	tests := []struct {
+		input          string
+		expectedOutput string
+		expectedStatus int
+	}{
+		{"x=1; x=2 & wait; echo $x\n", "1\n", 0},
+		{"echo bg & wait; echo fg\n", "bg\nfg\n", 0},
+		{"(cd /; sleep 0.2) & pwd; wait; pwd\n", cwd + "\n" + cwd + "\n", 0},
+		{"cd / & wait; pwd\n", cwd + "\n", 0},
+		{"(exit 3) & wait %1\n", "", 3},
+		{"(exit 3) & let 0 & wait\n", "", 0},
+		{"(exit 5) & fg\n", "", 5},
+		{"let 0 && echo no || echo yes & wait %+\n", "yes\n", 0},
+		{"wait %1\n", "", 127},
+		{"wait 1\n", "", 127},
+		{"fg\n", "", 1},
+		{"bg %2\n", "", 1},
+		{"jobs -x\n", "", 2},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		output := runScript(t, shell, tt.input)
+		if output != tt.expectedOutput {
+			t.Fatalf("%d: expected output %q, got %q\n", i, tt.expectedOutput, output)
+		}
+		if shell.status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, shell.status)
+		}
+		if len(shell.jobs.list) != 0 {
+			t.Fatalf("%d: expected the jobs waited for to be removed, got %d\n", i, len(shell.jobs.list))
+		}
+	}
+
+	runScript(t, shell, "let 0 &\n{ exit 2; } &\n")
+	for _, j := range shell.jobs.list {
+		<-j.done
+	}
+	output := runScript(t, shell, "jobs\n")
+	expected := "[1]-  Exit 1                  let 0\n[2]+  Exit 2                  { exit 2; }\n"
+	if output != expected {
+		t.Fatalf("expected jobs to list %q, got %q\n", expected, output)
+	}
+	if len(shell.jobs.list) != 0 {
+		t.Fatalf("expected the jobs listed as done to be removed, got %d\n", len(shell.jobs.list))
+	}
+}
+
+func TestStopJob(t *testing.T) {
+	shell := NewShell(context.Background())
+	runScript(t, shell, "sleep 10 &\n")
+	j := shell.jobs.list[0]
+	waitFor := func(paused bool) {
+		for range 100 {
+			if j.group.isPaused() == paused {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("expected the job to be paused: %t\n", paused)
+	}
+
+	runScript(t, shell, "kill -STOP $(jobs -p)\n")
+	waitFor(true)
+	expected := "[1]+  Stopped (signal)        sleep 10\n"
+	if output := runScript(t, shell, "jobs\n"); output != expected {
+		t.Fatalf("expected jobs to list %q, got %q\n", expected, output)
+	}
+
+	runScript(t, shell, "bg\n")
+	waitFor(false)
+	expected = "[1]+  Running                 sleep 10 &\n"
+	if output := runScript(t, shell, "jobs\n"); output != expected {
+		t.Fatalf("expected jobs to list %q, got %q\n", expected, output)
+	}
+
+	runScript(t, shell, "kill $(jobs -p); wait %1\n")
+	if shell.status != 128+int(syscall.SIGTERM) {
+		t.Fatalf("expected status %d, got %d\n", 128+int(syscall.SIGTERM), shell.status)
+	}
+}
+
+func TestFindJob(t *testing.T) {
+	shell := NewShell(context.Background())
+	shell.jobs.list = []*job{{id: 1, source: "sleep 10"}, {id: 3, source: "sleep 20"}, {id: 4, source: "echo hi"}}
+
+	tests := []struct {
+		spec       string
+		expectedId int // 0 if it's an error
+	}{
+		{"%1", 1},
+		{"%3", 3},
+		{"%2", 0},
+		{"%", 4},
+		{"%+", 4},
+		{"%%", 4},
+		{"%-", 3},
+		{"%ec", 4},
+		{"%sleep", 0}, // ambiguous
+		{"%?20", 3},
+		{"%?sleep 1", 1},
+		{"%?x", 0},
+		{"1", 0},
+	}
+
+	for _, tt := range tests {
+		j, err := shell.findJob(tt.spec)
+		if tt.expectedId == 0 {
+			if err == nil {
+				t.Fatalf("%s: expected an error, got job %d\n", tt.spec, j.id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", tt.spec, err.Error())
+		}
+		if j.id != tt.expectedId {
+			t.Fatalf("%s: expected job %d, got %d\n", tt.spec, tt.expectedId, j.id)
+		}
+	}
+
+	runScript(t, shell, "disown %3\n")
+	if len(shell.jobs.list) != 2 || shell.jobs.list[1].id != 4 {
+		t.Fatalf("expected job 3 to be disowned, got %d jobs\n", len(shell.jobs.list))
+	}
+	runScript(t, shell, "disown -a\n")
+	if len(shell.jobs.list) != 0 {
+		t.Fatalf("expected all jobs to be disowned, got %d\n", len(shell.jobs.list))
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		matched bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "main.gox", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"[a-c]x", "bx", true},
+		{"[!a-c]x", "bx", false},
+		{"[]]", "]", true},
+		{"[[:digit:]]*", "1a", true},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"[ab", "[ab", true},
+		{"ü?", "üß", true},
+	}
+
+	for i, tt := range tests {
+		if matchPattern(tt.pattern, tt.s) != tt.matched {
+			t.Fatalf("%d: expected %q matching %q to be %v\n", i, tt.pattern, tt.s, tt.matched)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "c.txt", ".hidden.go", "dir/x.go", "dir/y.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cwd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	tests := []struct {
+		input        string
+		shopt        string
+		expectedArgs []string
+	}{
+		{"echo *.go\n", "", []string{"echo", "a.go", "b.go"}},
+		{"echo \"*.go\" '*'.go \\*.go\n", "", []string{"echo", "*.go", "*.go", "*.go"}},
+		{"echo .*.go [bc].* ?.txt\n", "", []string{"echo", ".hidden.go", "b.go", "c.txt", "c.txt"}},
+		{"echo */*.go d*/ dir/y.txt " + dir + "/dir/*.txt\n", "", []string{"echo", "dir/x.go", "dir/", "dir/y.txt", dir + "/dir/y.txt"}},
+		{"echo *.none [\n", "", []string{"echo", "*.none", "["}},
+		{"echo *.none\n", "nullglob", []string{"echo"}},
+	}
 
-		sets := splitAtPipe(parser.tokens)
-		if len(sets) != len(tt.expectedTokSets) {
-			t.Fatalf("%d: expected %d token sets in %s, got %d\n",
-				i, len(tt.expectedTokSets), tt.input, len(sets))
+	for i, tt := range tests {
+		shell := NewShell(context.Background())
+		if tt.shopt != "" {
+			shell.shopts[tt.shopt] = true
+		}
+		cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
 		}
+		if strings.Join(cmd.argv, " ") != strings.Join(tt.expectedArgs, " ") {
+			t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
+		}
+	}
+
+	shell := NewShell(context.Background())
+	shell.shopts["failglob"] = true
+	if _, err := shell.expandSimpleCmd(parseSimpleCmd(t, "echo *.none\n")); err == nil || err.Error() != "no match: *.none" {
+		t.Fatalf("expected no match error, got %v\n", err)
+	}
+}
 
-		for i := range sets {
-			set := sets[i]
-			expectedSet := tt.expectedTokSets[i]
+func TestBraceExpansion(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedArgs []string
+	}{
+		{"mkdir -p src/{api,web,cli}\n", []string{"mkdir", "-p", "src/api", "src/web", "src/cli"}},
+		{"echo {1..5} {a,b}{1,2}\n", []string{"echo", "1", "2", "3", "4", "5", "a1", "a2", "b1", "b2"}},
+		{"echo {1..10..3} {5..1..2} {a..e..2} {01..3} {-1..1}\n", []string{"echo", "1", "4", "7", "10", "5", "3", "1", "a", "c", "e", "01", "02", "03", "-1", "0", "1"}},
+		{"echo {a,b{1,2}}x a{,b} {'a b',c}\n", []string{"echo", "ax", "b1x", "b2x", "a", "ab", "a b", "c"}},
+		{"echo \"{a,b}\" {a} {} {a{b,c}} {a\\,b} {1..a} {a..\n", []string{"echo", "{a,b}", "{a}", "{}", "{ab}", "{ac}", "{a,b}", "{1..a}", "{a.."}},
+		{"echo {9223372036854775806..9223372036854775807} {-9223372036854775807..-9223372036854775808..5}\n", []string{"echo", "9223372036854775806", "9223372036854775807", "-9223372036854775807"}},
+		{"echo {1..100000000000} {1..5..-9223372036854775808} {0..9223372036854775807..2}\n", []string{"echo", "{1..100000000000}", "{1..5..-9223372036854775808}", "{0..9223372036854775807..2}"}},
+	}
 
-			if len(set) != len(expectedSet) {
-				t.Fatalf("%d: expected %d tokens in %s, got %d\n",
-					i, len(tt.expectedTokSets), tt.input, len(sets))
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		if strings.Join(cmd.argv, "|") != strings.Join(tt.expectedArgs, "|") {
+			t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
+		}
+	}
+}
+
+func TestTildeExpansion(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	t.Setenv("PWD", "/cwd")
+	t.Setenv("OLDPWD", "/old")
+	os.Unsetenv("UNSET")
+	self, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		input        string
+		expectedArgs []string
+	}{
+		{"echo ~ ~/x ~+ ~-/y\n", []string{"echo", "/home/me", "/home/me/x", "/cwd", "/old/y"}},
+		{"echo ~" + self.Username + "/a ~no-such-user/a\n", []string{"echo", self.HomeDir + "/a", "~no-such-user/a"}},
+		{"echo \"~\" \\~ ~\"/x\" a~ ${UNSET:-~/d} ~$UNSET\n", []string{"echo", "~", "~", "~/x", "a~", "/home/me/d", "~"}},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, tt.input))
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		if strings.Join(cmd.argv, "|") != strings.Join(tt.expectedArgs, "|") {
+			t.Fatalf("%d: expected args %q, got %q\n", i, tt.expectedArgs, cmd.argv)
+		}
+	}
+
+	cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, "echo > ~/out\n"))
+	if err != nil || cmd.redirects[0].target != "/home/me/out" {
+		t.Fatalf("expected the redirection target to be expanded, got %q, %v\n", cmd.redirects, err)
+	}
+}
+
+func TestArith(t *testing.T) {
+	t.Setenv("N", "7")
+	t.Setenv("EXPR", "N * 2")
+	os.Unsetenv("I")
+
+	tests := []struct {
+		expr        string
+		expected    int64
+		expectedErr string
+	}{
+		{"1 + 2 * 3 - 4 / 2", 5, ""},
+		{"(1 + 2) * 3 % 4", 1, ""},
+		{"-2 ** 2 + 2 ** 3 ** 2", 516, ""},
+		{"2 ** 100000000000 + 3 ** (2 ** 62 + 1) + (-1) ** 100000000001 + 7 ** 0", 3, ""},
+		{"1 << 4 | 3 & 2 ^ 1", 19, ""},
+		{"!0 + ~0 + (3 > 2) + (2 >= 3) + (1 == 1) + (1 != 1)", 2, ""},
+		{"0x1f + 010 + 2#101 + 64#_", 107, ""},
+		{"N + EXPR + UNSET", 21, ""},
+		{"I = 5, I += 2, I *= 3, I <<= 1, I", 42, ""},
+		{"I++ + ++I", 86, ""},
+		{"I--, --I", 42, ""},
+		{"N > 5 ? 1 : 2", 1, ""},
+		{"0 && (I = 1), 1 || (I = 2), 0 ? I = 3 : I", 42, ""},
+		{"1 / 0", 0, "1 / 0: division by 0"},
+		{"0 && 1 / 0", 0, ""},
+		{"1 +", 0, "1 +: syntax error: operand expected (error token is \"\")"},
+		{"(1", 0, "(1: syntax error: operand expected (error token is \"\")"},
+		{"1 2", 0, "1 2: syntax error in expression (error token is \"2\")"},
+		{"9223372036854775807 + 1", -9223372036854775808, ""},
+	}
+
+	shell := NewShell(context.Background())
+	for i, tt := range tests {
+		n, err := shell.evalArith(tt.expr)
+		if tt.expectedErr != "" {
+			if err == nil || err.Error() != tt.expectedErr {
+				t.Fatalf("%d: expected error %q, got %v\n", i, tt.expectedErr, err)
 			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		if n != tt.expected {
+			t.Fatalf("%d: expected %q to be %d, got %d\n", i, tt.expr, tt.expected, n)
+		}
+	}
+}
+
+func TestArithSyntax(t *testing.T) {
+	t.Setenv("N", "4")
+
+	shell := NewShell(context.Background())
+	cmd, err := shell.expandSimpleCmd(parseSimpleCmd(t, "echo $((N * (2 + 1))) \"$(( $N ))\" $(( $(echo 2) ** 3 ))x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cmd.argv, " ") != "echo 12 4 8x" {
+		t.Fatalf("expected arithmetic expansions to be evaluated, got %q\n", cmd.argv)
+	}
 
+	tests := []struct {
+		input          string
+		expectedStatus int
+	}{
+		{"(( N > 3 ))\n", 0},
+		{"((N - 4))\n", 1},
+		{"((1 / 0))\n", 1},
+	}
+	for i, tt := range tests {
+		list, err := parse(tt.input)
+		if err != nil {
+			t.Fatalf("%d: %s\n", i, err.Error())
+		}
+		status, _ := shell.runPipeline(list.Items[0].Pipelines[0])
+		if status != tt.expectedStatus {
+			t.Fatalf("%d: expected status %d, got %d\n", i, tt.expectedStatus, status)
 		}
 	}
 }
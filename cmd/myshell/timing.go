@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the formats `time` reports in if TIMEFORMAT isn't set, and with -p
+const (
+	defaultTimeFormat = "\nreal\t%3lR\nuser\t%3lU\nsys\t%3lS"
+	posixTimeFormat   = "real %2R\nuser %2U\nsys %2S"
+)
+
+// cpuUsage adds up the user and system CPU time of the processes a timed
+// pipeline runs, those of its subshells included.
+type cpuUsage struct {
+	mu     sync.Mutex
+	user   time.Duration
+	sys    time.Duration
+	parent *cpuUsage // the one of the pipeline timed around it, if any
+}
+
+// add adds the CPU time a process used once it's reaped, to the pipelines
+// timed around it as well. Nothing is timed if u is nil.
+func (u *cpuUsage) add(user, sys time.Duration) {
+	for ; u != nil; u = u.parent {
+		u.mu.Lock()
+		u.user += user
+		u.sys += sys
+		u.mu.Unlock()
+	}
+}
+
+func (u *cpuUsage) times() (time.Duration, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.user, u.sys
+}
+
+// startTimer starts timing a pipeline and returns the function reporting
+// the times once it's done: the real time passed and the user and system
+// CPU time. The latter is that of the processes the pipeline ran, as
+// reported when they were reaped, plus the share of the shell process
+// itself for the builtins and subshells run in it. That share includes
+// whatever else the shell did meanwhile, e.g. for background jobs, which
+// can't be told apart from the pipeline within the same process.
+func (shell *Shell) startTimer(posix bool) func() {
+	start := time.Now()
+	selfUser, selfSys := selfTimes()
+	usage := &cpuUsage{parent: shell.timer}
+	shell.timer = usage
+
+	return func() {
+		shell.timer = usage.parent
+		real := time.Since(start)
+		endUser, endSys := selfTimes()
+		user, sys := usage.times()
+		user += endUser - selfUser
+		sys += endSys - selfSys
+
+		format := posixTimeFormat
+		if !posix {
+			format = defaultTimeFormat
+			if value, ok := shell.lookupVar("TIMEFORMAT"); ok {
+				format = value
+			}
+		}
+		if format == "" {
+			// set to nothing to turn the report off
+			return
+		}
+		fmt.Fprintln(shell.stderr, formatTimes(format, real, user, sys))
+	}
+}
+
+// selfTimes returns the user and system CPU time the shell process used so
+// far.
+func selfTimes() (time.Duration, time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano())
+}
+
+// formatTimes expands the escapes of format the way bash does for
+// TIMEFORMAT: %[p][l]R, %[p][l]U and %[p][l]S are the real, user and system
+// time in seconds with p digits after the point, 3 by default, in the form
+// MmS.FFFs with l. %P is the percentage of CPU used and %% a '%'. Other
+// escapes are taken literally.
+func formatTimes(format string, real, user, sys time.Duration) string {
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+
+		start := i
+		precision, long := 3, false
+		if i+1 < len(format) && isDigit(format[i+1]) {
+			precision = min(int(format[i+1]-'0'), 3)
+			i++
+		}
+		if i+1 < len(format) && format[i+1] == 'l' {
+			long = true
+			i++
+		}
+		if i+1 == len(format) {
+			sb.WriteString(format[start:])
+			break
+		}
+		i++
+
+		switch format[i] {
+		case '%':
+			sb.WriteByte('%')
+		case 'R':
+			sb.WriteString(formatSeconds(real, precision, long))
+		case 'U':
+			sb.WriteString(formatSeconds(user, precision, long))
+		case 'S':
+			sb.WriteString(formatSeconds(sys, precision, long))
+		case 'P':
+			percent := 0.0
+			if real > 0 {
+				percent = float64(user+sys) / float64(real) * 100
+			}
+			sb.WriteString(strconv.FormatFloat(percent, 'f', 2, 64))
+		default:
+			sb.WriteString(format[start : i+1])
+		}
+	}
+	return sb.String()
+}
+
+// formatSeconds formats d in seconds with precision digits after the point,
+// truncated, or as minutes and seconds like 1m2.345s if long is set.
+func formatSeconds(d time.Duration, precision int, long bool) string {
+	ms := d.Milliseconds()
+	secs, frac := ms/1000, ms%1000
+
+	s := strconv.FormatInt(secs, 10)
+	if long {
+		s = fmt.Sprintf("%dm%d", secs/60, secs%60)
+	}
+	if precision > 0 {
+		s += "." + fmt.Sprintf("%03d", frac)[:precision]
+	}
+	if long {
+		s += "s"
+	}
+	return s
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// variable is a shell variable. Only exported variables are passed on to the
+// environment of the commands the shell runs. A variable can be exported or
+// readonly without being set.
+type variable struct {
+	value    string
+	set      bool
+	exported bool
+	readonly bool
+	array    []string // the elements of an indexed array, value being the first one
+}
+
+// assignment is a `name=value` prefix of a simple command with its value
+// expanded.
+type assignment struct {
+	name  string
+	value string
+}
+
+// environVars returns the variables of the environment the shell was started
+// with, all of them exported.
+func environVars() map[string]variable {
+	vars := map[string]variable{}
+	for _, kv := range os.Environ() {
+		name, value, found := strings.Cut(kv, "=")
+		if found && isName(name) {
+			vars[name] = variable{value: value, set: true, exported: true}
+		}
+	}
+	return vars
+}
+
+func (shell *Shell) lookupVar(name string) (string, bool) {
+	v := shell.vars[name]
+	return v.value, v.set
+}
+
+func (shell *Shell) setVar(name string, value string) error {
+	v := shell.vars[name]
+	if v.readonly {
+		return NewParamError(name, "readonly variable")
+	}
+	v.value = value
+	v.set = true
+	if len(v.array) > 0 {
+		v.array = slices.Clone(v.array)
+		v.array[0] = value
+	}
+	shell.vars[name] = v
+	return nil
+}
+
+// setArray sets name to an indexed array of values, whose first element is
+// the value of `$name`.
+func (shell *Shell) setArray(name string, values []string) error {
+	v := shell.vars[name]
+	if v.readonly {
+		return NewParamError(name, "readonly variable")
+	}
+	v.array = values
+	v.value, v.set = "", len(values) > 0
+	if v.set {
+		v.value = values[0]
+	}
+	shell.vars[name] = v
+	return nil
+}
+
+// elements returns the elements of the array name. A variable that isn't
+// an array is one with a single element.
+func (shell *Shell) elements(name string) []string {
+	switch v := shell.vars[name]; {
+	case v.array != nil:
+		return v.array
+	case v.set:
+		return []string{v.value}
+	}
+	return nil
+}
+
+func (shell *Shell) unsetVar(name string) error {
+	if shell.vars[name].readonly {
+		return NewParamError(name, "cannot unset: readonly variable")
+	}
+	delete(shell.vars, name)
+	return nil
+}
+
+// assign performs assignments in order.
+func (shell *Shell) assign(assigns []assignment) error {
+	for _, a := range assigns {
+		if err := shell.setVar(a.name, a.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withAssigns runs f with the assignments made temporarily, the way a
+// builtin sees the assignments preceding it.
+func (shell *Shell) withAssigns(assigns []assignment, f func() (int, error)) (int, error) {
+	saved := map[string]variable{}
+	for _, a := range assigns {
+		if _, ok := saved[a.name]; !ok {
+			saved[a.name] = shell.vars[a.name]
+		}
+	}
+	if err := shell.assign(assigns); err != nil {
+		return 1, err
+	}
+
+	defer func() {
+		for name, v := range saved {
+			if v.set || v.exported || v.readonly {
+				shell.vars[name] = v
+			} else {
+				delete(shell.vars, name)
+			}
+		}
+	}()
+	return f()
+}
+
+// environ returns the environment of a command: the exported variables
+// overridden by the assignments preceding the command.
+func (shell *Shell) environ(assigns []assignment) []string {
+	env := map[string]string{}
+	for name, v := range shell.vars {
+		if v.exported && v.set {
+			env[name] = v.value
+		}
+	}
+	for _, a := range assigns {
+		env[a.name] = a.value
+	}
+
+	var environ []string
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+	slices.Sort(environ)
+	return environ
+}
+
+// lookPath finds the executable file name in the directories of the PATH
+// variable, unless name contains a slash. An assignment to PATH preceding
+// the command takes precedence over the variable of the shell.
+func (shell *Shell) lookPath(name string, assigns []assignment) (string, error) {
+	if strings.Contains(name, "/") {
+		if err := findExecutable(shell.dir, name); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+
+	path, _ := shell.lookupVar("PATH")
+	for _, a := range assigns {
+		if a.name == "PATH" {
+			path = a.value
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		file := filepath.Join(dir, name)
+		if !strings.Contains(file, "/") {
+			// keep exec.Command from looking it up in the PATH of the process
+			file = "./" + file
+		}
+		if err := findExecutable(shell.dir, file); err == nil {
+			return file, nil
+		}
+	}
+	return "", NewNotFoundError(name)
+}
+
+// findExecutable checks that file, relative to dir, can be executed.
+func findExecutable(dir string, file string) error {
+	info, err := os.Stat(inDir(dir, file))
+	if err != nil {
+		return NewNotFoundError(file)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s: %w", file, os.ErrPermission)
+	}
+	return nil
+}
+
+// export marks variables as exported, or not with -n, setting those given
+// as `name=value`. Without names it prints the exported variables.
+func (shell *Shell) export(argv []string) int {
+	args := argv[1:]
+	unexport := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-n":
+			unexport = true
+		case "-p":
+		default:
+			fmt.Fprintf(shell.stderr, "export: %s: invalid option\n", args[0])
+			fmt.Fprintln(shell.stderr, "export: usage: export [-n] [name[=value] ...] or export -p")
+			return 2
+		}
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return shell.printVars(EXPORT, func(v variable) bool { return v.exported })
+	}
+	return shell.declare(EXPORT, args, func(v *variable) { v.exported = !unexport })
+}
+
+// readonly marks variables as readonly, setting those given as `name=value`
+// first. Without names it prints the readonly variables.
+func (shell *Shell) readonly(argv []string) int {
+	args := argv[1:]
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return shell.printVars(READONLY, func(v variable) bool { return v.readonly })
+	}
+	return shell.declare(READONLY, args, func(v *variable) { v.readonly = true })
+}
+
+// declare sets the variables given as `name=value` or just `name` and
+// applies attr to them.
+func (shell *Shell) declare(builtin string, args []string, attr func(v *variable)) int {
+	status := 0
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !isName(name) {
+			fmt.Fprintf(shell.stderr, "%s: `%s': not a valid identifier\n", builtin, arg)
+			status = 1
+			continue
+		}
+		if hasValue {
+			if err := shell.setVar(name, value); err != nil {
+				fmt.Fprintf(shell.stderr, "%s: %s\n", builtin, err.Error())
+				status = 1
+				continue
+			}
+		}
+		v := shell.vars[name]
+		attr(&v)
+		shell.vars[name] = v
+	}
+	return status
+}
+
+// printVars prints the variables matching filter the way they can be
+// declared again.
+func (shell *Shell) printVars(builtin string, filter func(v variable) bool) int {
+	out := shell.builtinStdout(builtin)
+
+	names := make([]string, 0, len(shell.vars))
+	for name, v := range shell.vars {
+		if filter(v) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		v := shell.vars[name]
+		flags := ""
+		if v.readonly {
+			flags += "r"
+		}
+		if v.exported {
+			flags += "x"
+		}
+		if v.set {
+			fmt.Fprintf(out, "declare -%s %s=\"%s\"\n", flags, name, escapeDblQuoted(v.value))
+		} else {
+			fmt.Fprintf(out, "declare -%s %s\n", flags, name)
+		}
+	}
+	return 0
+}
+
+// unset unsets variables, or functions with -f. Without either -v or -f a
+// name that isn't a variable unsets the function of that name.
+func (shell *Shell) unset(argv []string) int {
+	args := argv[1:]
+	mode := ""
+	if len(args) > 0 && (args[0] == "-v" || args[0] == "-f") {
+		mode = args[0]
+		args = args[1:]
+	}
+
+	status := 0
+	for _, name := range args {
+		if mode == "-f" || (mode == "" && !isName(name) && shell.funcs[name] != nil) {
+			delete(shell.funcs, name)
+			continue
+		}
+		if !isName(name) {
+			fmt.Fprintf(shell.stderr, "unset: `%s': not a valid identifier\n", name)
+			status = 1
+			continue
+		}
+		if _, ok := shell.vars[name]; !ok && mode == "" {
+			delete(shell.funcs, name)
+			continue
+		}
+		if err := shell.unsetVar(name); err != nil {
+			fmt.Fprintf(shell.stderr, "unset: %s\n", err.Error())
+			status = 1
+		}
+	}
+	return status
+}
+
+// builtinStdout returns the stdout of a builtin printing several lines. The
+// first write failing, e.g. to a closed fd, is reported and the rest are
+// dropped.
+func (shell *Shell) builtinStdout(builtin string) io.Writer {
+	return &builtinWriter{shell: shell, builtin: builtin}
+}
+
+type builtinWriter struct {
+	shell   *Shell
+	builtin string
+	failed  bool
+}
+
+func (w *builtinWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return len(p), nil
+	}
+	if _, err := w.shell.stdout.Write(p); err != nil {
+		w.failed = true
+		_ = w.shell.writeError(w.builtin, err)
+	}
+	return len(p), nil
+}
+
+// writeError reports a builtin failing to write its output and returns its
+// status. Writing to a pipe whose reader is gone is taken as SIGPIPE, which
+// stops the loops of a subshell the way it would kill a process.
+func (shell *Shell) writeError(builtin string, err error) int {
+	if errors.Is(err, syscall.EPIPE) {
+		select {
+		case shell.sigint <- syscall.SIGPIPE:
+		default:
+		}
+		return 128 + int(syscall.SIGPIPE)
+	}
+	msg := err.Error()
+	if errors.Is(err, syscall.EBADF) {
+		msg = "Bad file descriptor"
+	}
+	fmt.Fprintf(shell.stderr, "%s: write error: %s\n", builtin, msg)
+	return 1
+}
+
+// escapeDblQuoted escapes the characters special in double quotes.
+func escapeDblQuoted(s string) string {
+	var sb strings.Builder
+	for _, ch := range s {
+		switch ch {
+		case '"', '\\', '$', '`':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}